@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// commands are the subcommands that don't start the gui
+var commands = map[string]func(client HistoryClient, conf *Config, args []string) error{
+	"list":    listCommand,
+	"get":     getCommand,
+	"copy":    copyCommand,
+	"delete":  deleteCommand,
+	"add":     addCommand,
+	"search":  searchCommand,
+	"pick":    pickCommand,
+	"lock":    lockCommand,
+	"unlock":  unlockCommand,
+	"encrypt": encryptCommand,
+	"decrypt": decryptCommand,
+	"pause":   pauseCommand,
+	"resume":  resumeCommand,
+}
+
+// isCommand returns whether name is a known subcommand
+func isCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// runCommand runs the subcommand given in args and returns the exit code.
+func runCommand(args []string) int {
+	conf := NewConfig()
+
+	client, err := NewHistoryClient(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := commands[args[0]](client, conf, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func listCommand(client HistoryClient, conf *Config, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Prints the entries as JSON")
+	limit := flags.Int("limit", 0, "Maximum amount of entries to print")
+	flags.Parse(args)
+
+	entries, err := client.List(*limit)
+	if err != nil {
+		return err
+	}
+
+	return printEntries(entries, *asJson, previewLength(conf))
+}
+
+func getCommand(client HistoryClient, _ *Config, args []string) error {
+	id, err := entryIdArg(args)
+	if err != nil {
+		return err
+	}
+
+	entry, err := client.Get(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(*entry.str)
+
+	return nil
+}
+
+func copyCommand(client HistoryClient, _ *Config, args []string) error {
+	id, err := entryIdArg(args)
+	if err != nil {
+		return err
+	}
+
+	return client.Copy(id)
+}
+
+func deleteCommand(client HistoryClient, _ *Config, args []string) error {
+	id, err := entryIdArg(args)
+	if err != nil {
+		return err
+	}
+
+	return client.Delete(id)
+}
+
+// addCommand adds the text read from stdin to the history
+func addCommand(client HistoryClient, _ *Config, _ []string) error {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return errors.New("Nothing to add")
+	}
+
+	return client.Add(text)
+}
+
+func searchCommand(client HistoryClient, conf *Config, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Prints the entries as JSON")
+	flags.Parse(args)
+
+	query := strings.Join(flags.Args(), " ")
+	if query == "" {
+		return errors.New("Missing search query")
+	}
+
+	entries, err := client.Search(query)
+	if err != nil {
+		return err
+	}
+
+	return printEntries(entries, *asJson, previewLength(conf))
+}
+
+// pickCommand integrates bbclip with dmenu like launchers. With --dmenu
+// it prints the history in a format the launcher can display, with --copy
+// it reads the line chosen in the launcher from stdin and copies the
+// corresponding entry. --launcher runs both steps with the given command:
+//
+//	bbclip pick --dmenu | fuzzel --dmenu | bbclip pick --copy
+//	bbclip pick --launcher "fuzzel --dmenu"
+func pickCommand(client HistoryClient, conf *Config, args []string) error {
+	flags := flag.NewFlagSet("pick", flag.ExitOnError)
+	dmenu := flags.Bool("dmenu", false, "Prints the history for dmenu like launchers")
+	cp := flags.Bool("copy", false, "Copies the entry of the line read from stdin")
+	launcher := flags.String("launcher", "", "Runs the launcher and copies the chosen entry")
+	flags.Parse(args)
+
+	length := previewLength(conf)
+
+	switch {
+	case *launcher != "":
+		entries, err := client.List(0)
+		if err != nil {
+			return err
+		}
+
+		var list bytes.Buffer
+		printDmenu(&list, entries, length)
+
+		cmd := exec.Command("sh", "-c", *launcher)
+		cmd.Stdin = &list
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			// most launchers exit with an error if nothing was chosen
+			return nil
+		}
+
+		return copyPicked(client, entries, string(out), length)
+
+	case *cp:
+		entries, err := client.List(0)
+		if err != nil {
+			return err
+		}
+
+		line, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		return copyPicked(client, entries, string(line), length)
+
+	case *dmenu:
+		entries, err := client.List(0)
+		if err != nil {
+			return err
+		}
+
+		printDmenu(os.Stdout, entries, length)
+		return nil
+	}
+
+	return errors.New("Expected one of --dmenu, --copy or --launcher")
+}
+
+// pauseCommand stops capturing the clipboard, with --for only for the
+// given duration
+func pauseCommand(client HistoryClient, _ *Config, args []string) error {
+	flags := flag.NewFlagSet("pause", flag.ExitOnError)
+	duration := flags.Duration("for", 0, "Resumes automatically after the duration, e.g. 10m")
+	flags.Parse(args)
+
+	return client.Pause(*duration)
+}
+
+func resumeCommand(client HistoryClient, _ *Config, _ []string) error {
+	return client.Resume()
+}
+
+func lockCommand(client HistoryClient, _ *Config, _ []string) error {
+	return client.Lock()
+}
+
+func unlockCommand(client HistoryClient, conf *Config, _ []string) error {
+	passphrase, err := commandPassphrase(conf, false)
+	if err != nil {
+		return err
+	}
+
+	return client.Unlock(passphrase)
+}
+
+// encryptCommand encrypts an unencrypted history
+func encryptCommand(client HistoryClient, conf *Config, _ []string) error {
+	passphrase, err := commandPassphrase(conf, true)
+	if err != nil {
+		return err
+	}
+
+	damaged, err := client.Encrypt(passphrase)
+	if err != nil {
+		return err
+	}
+
+	if len(damaged) > 0 {
+		fmt.Fprintln(os.Stderr, "Unencrypted copies of damaged history files are left in place, remove them once they're not needed anymore:")
+		for _, path := range damaged {
+			fmt.Fprintln(os.Stderr, "  "+path)
+		}
+	}
+
+	return nil
+}
+
+// decryptCommand stores an encrypted history unencrypted again. A
+// locked history is unlocked first.
+func decryptCommand(client HistoryClient, conf *Config, _ []string) error {
+	locked, err := client.Locked()
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		passphrase, err := commandPassphrase(conf, false)
+		if err != nil {
+			return err
+		}
+
+		if err := client.Unlock(passphrase); err != nil {
+			return err
+		}
+	}
+
+	return client.Decrypt()
+}
+
+// commandPassphrase returns the passphrase of the configured key source
+// or asks for it. A new passphrase typed into the terminal has to be
+// repeated.
+func commandPassphrase(conf *Config, confirm bool) (string, error) {
+	passphrase, ok, err := keySourcePassphrase(conf)
+	if ok || err != nil {
+		return passphrase, err
+	}
+
+	passphrase, err = readPassphrase("Passphrase: ")
+	if err != nil {
+		return "", err
+	}
+
+	if confirm && isTerminal(os.Stdin) {
+		repeated, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+
+		if repeated != passphrase {
+			return "", errors.New("Passphrases don't match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+// printDmenu prints one entry per line prefixed by its id. The id keeps
+// the lines distinguishable even if their previews are the same.
+func printDmenu(w io.Writer, entries []HistoryEntry, length int) {
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%d\t%s\n", entry.id, entryPreview(entry, length))
+	}
+}
+
+// copyPicked copies the entry of the given dmenu line. Launchers that
+// hide the id column return the preview only, in that case the most
+// recent entry with the same preview is copied.
+func copyPicked(
+	client HistoryClient,
+	entries []HistoryEntry,
+	line string,
+	length int,
+) error {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil
+	}
+
+	if prefix, _, ok := strings.Cut(line, "\t"); ok {
+		if id, err := strconv.ParseUint(prefix, 10, 64); err == nil {
+			return client.Copy(id)
+		}
+	}
+
+	for _, entry := range entries {
+		if entryPreview(entry, length) == line {
+			return client.Copy(entry.id)
+		}
+	}
+
+	return errors.New("No entry found")
+}
+
+// printEntries prints one entry per line prefixed by its id, or all
+// entries as JSON array if asJson is true. Masked secrets are printed as
+// their mask either way, get prints the secret itself.
+func printEntries(entries []HistoryEntry, asJson bool, length int) error {
+	if asJson {
+		masked := make([]HistoryEntry, 0, len(entries))
+		for _, entry := range entries {
+			masked = append(masked, maskedEntry(entry))
+		}
+
+		return json.NewEncoder(os.Stdout).Encode(storedEntries(masked))
+	}
+
+	printDmenu(os.Stdout, entries, length)
+
+	return nil
+}
+
+// entryPreview returns the entry as a single line, truncated to the
+// given length. Masked secrets are replaced by a placeholder.
+func entryPreview(entry HistoryEntry, length int) string {
+	if entry.secret != "" {
+		return maskSecret(entry)
+	}
+
+	return textPreview(entry, length)
+}
+
+// textPreview returns the entry as a single line, truncated to the
+// given length, even if it's a masked secret
+func textPreview(entry HistoryEntry, length int) string {
+	preview := strings.ReplaceAll(*entry.str, "\n", "↲")
+	return TruncateText(preview, length)
+}
+
+func previewLength(conf *Config) int {
+	return conf.IntVal(TextPreviewLen, *flagTextPreviewLength)
+}
+
+func entryIdArg(args []string) (uint64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("Expected exactly one entry id")
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid entry id " + args[0])
+	}
+
+	return id, nil
+}
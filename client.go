@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HistoryClient gives access to the history either through the running
+// bbclip instance or, if bbclip isn't running, by reading and writing the
+// history file directly.
+type HistoryClient interface {
+	// List returns the entries, the most recent first. A limit of 0
+	// returns all entries.
+	List(limit int) ([]HistoryEntry, error)
+	Get(id uint64) (HistoryEntry, error)
+	Copy(id uint64) error
+	Delete(id uint64) error
+	Pin(id uint64, pinned bool) error
+	Add(text string) error
+	Search(query string) ([]HistoryEntry, error)
+	// Locked returns whether the history is encrypted and locked
+	Locked() (bool, error)
+	Lock() error
+	Unlock(passphrase string) error
+	// Encrypt encrypts the history with the passphrase and returns the
+	// unencrypted copies of damaged history files, Decrypt stores it
+	// unencrypted again
+	Encrypt(passphrase string) (damaged []string, err error)
+	Decrypt() error
+	// Pause pauses capturing the clipboard, for the given duration if
+	// it isn't zero
+	Pause(duration time.Duration) error
+	Resume() error
+	// Paused returns whether capturing is paused and until when, until
+	// is zero if it's paused until it's resumed
+	Paused() (paused bool, until time.Time, err error)
+}
+
+// NewHistoryClient returns a client talking to the running instance
+// and falls back to the history file if no instance is running.
+func NewHistoryClient(conf *Config) (HistoryClient, error) {
+	path := SocketPath(conf)
+
+	_, _, err := SocketRequest(path, "STATUS")
+	if err == nil {
+		return &SocketClient{path: path}, nil
+	}
+
+	if !errors.Is(err, ErrNotRunning) {
+		return nil, err
+	}
+
+	history, err := OpenHistory(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalClient{history: history}, nil
+}
+
+// SocketClient sends the commands to the running instance.
+type SocketClient struct {
+	path string
+}
+
+func (c *SocketClient) List(limit int) ([]HistoryEntry, error) {
+	return c.entries(fmt.Sprintf("LIST %d", limit))
+}
+
+func (c *SocketClient) Get(id uint64) (HistoryEntry, error) {
+	_, data, err := SocketRequest(c.path, fmt.Sprintf("GET %d", id))
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	var stored storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return HistoryEntry{}, err
+	}
+
+	return stored.entry(), nil
+}
+
+func (c *SocketClient) Copy(id uint64) error {
+	_, _, err := SocketRequest(c.path, fmt.Sprintf("COPY %d", id))
+	return err
+}
+
+func (c *SocketClient) Delete(id uint64) error {
+	_, _, err := SocketRequest(c.path, fmt.Sprintf("DELETE %d", id))
+	return err
+}
+
+func (c *SocketClient) Pin(id uint64, pinned bool) error {
+	cmd := "UNPIN"
+	if pinned {
+		cmd = "PIN"
+	}
+
+	_, _, err := SocketRequest(c.path, fmt.Sprintf("%s %d", cmd, id))
+	return err
+}
+
+func (c *SocketClient) Add(text string) error {
+	// the text is sent as JSON string so that it fits on a single line
+	arg, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = SocketRequest(c.path, "ADD "+string(arg))
+	return err
+}
+
+func (c *SocketClient) Search(query string) ([]HistoryEntry, error) {
+	return c.entries("SEARCH " + query)
+}
+
+func (c *SocketClient) Locked() (bool, error) {
+	status, err := c.status()
+	if err != nil {
+		return false, err
+	}
+
+	return status.Locked, nil
+}
+
+func (c *SocketClient) Pause(duration time.Duration) error {
+	cmd := "PAUSE"
+	if duration > 0 {
+		cmd += " " + duration.String()
+	}
+
+	_, _, err := SocketRequest(c.path, cmd)
+	return err
+}
+
+func (c *SocketClient) Resume() error {
+	_, _, err := SocketRequest(c.path, "RESUME")
+	return err
+}
+
+func (c *SocketClient) Paused() (bool, time.Time, error) {
+	status, err := c.status()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if status.PausedUntil != nil {
+		return status.Paused, *status.PausedUntil, nil
+	}
+
+	return status.Paused, time.Time{}, nil
+}
+
+func (c *SocketClient) status() (Status, error) {
+	var status Status
+
+	_, data, err := SocketRequest(c.path, "STATUS")
+	if err != nil {
+		return status, err
+	}
+
+	err = json.Unmarshal(data, &status)
+	return status, err
+}
+
+func (c *SocketClient) Lock() error {
+	_, _, err := SocketRequest(c.path, "LOCK")
+	return err
+}
+
+func (c *SocketClient) Unlock(passphrase string) error {
+	return c.withPassphrase("UNLOCK", passphrase)
+}
+
+func (c *SocketClient) Encrypt(passphrase string) ([]string, error) {
+	arg, err := json.Marshal(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := SocketRequest(c.path, "ENCRYPT "+string(arg))
+	if err != nil {
+		return nil, err
+	}
+
+	var damaged []string
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &damaged)
+	}
+
+	return damaged, err
+}
+
+func (c *SocketClient) Decrypt() error {
+	_, _, err := SocketRequest(c.path, "DECRYPT")
+	return err
+}
+
+// withPassphrase sends the command with the passphrase as JSON string
+func (c *SocketClient) withPassphrase(cmd string, passphrase string) error {
+	arg, err := json.Marshal(passphrase)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = SocketRequest(c.path, cmd+" "+string(arg))
+	return err
+}
+
+func (c *SocketClient) entries(cmd string) ([]HistoryEntry, error) {
+	_, data, err := SocketRequest(c.path, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(stored))
+	for _, s := range stored {
+		entries = append(entries, s.entry())
+	}
+
+	return entries, nil
+}
+
+// LocalClient works on the history file directly.
+type LocalClient struct {
+	history *History
+}
+
+func (c *LocalClient) List(limit int) ([]HistoryEntry, error) {
+	entries := c.history.list()
+	if limit > 0 {
+		entries = entries[:min(limit, len(entries))]
+	}
+
+	return entries, nil
+}
+
+func (c *LocalClient) Get(id uint64) (HistoryEntry, error) {
+	entry, ok := c.history.get(id)
+	if !ok {
+		return entry, errors.New("No entry found")
+	}
+
+	return entry, nil
+}
+
+func (c *LocalClient) Copy(id uint64) error {
+	return c.history.copyEntry(id)
+}
+
+func (c *LocalClient) Delete(id uint64) error {
+	return c.history.removeEntry(id)
+}
+
+func (c *LocalClient) Pin(id uint64, pinned bool) error {
+	return c.history.setPinned(id, pinned)
+}
+
+func (c *LocalClient) Add(text string) error {
+	return c.history.add(NewHistoryEntry(text, nil, time.Now()))
+}
+
+func (c *LocalClient) Search(query string) ([]HistoryEntry, error) {
+	return c.history.search(query)
+}
+
+func (c *LocalClient) Locked() (bool, error) {
+	return c.history.isLocked(), nil
+}
+
+func (c *LocalClient) Lock() error {
+	return c.history.Lock()
+}
+
+func (c *LocalClient) Unlock(passphrase string) error {
+	return c.history.Unlock(passphrase)
+}
+
+func (c *LocalClient) Encrypt(passphrase string) ([]string, error) {
+	return c.history.Encrypt(passphrase)
+}
+
+func (c *LocalClient) Decrypt() error {
+	return c.history.Decrypt()
+}
+
+// Pause pauses the capture of the history. If bbclip isn't running
+// there's nothing to pause.
+func (c *LocalClient) Pause(duration time.Duration) error {
+	if c.history.watcher == nil {
+		return ErrNotRunning
+	}
+
+	c.history.Pause(duration)
+	return nil
+}
+
+func (c *LocalClient) Resume() error {
+	if c.history.watcher == nil {
+		return ErrNotRunning
+	}
+
+	c.history.Resume()
+	return nil
+}
+
+func (c *LocalClient) Paused() (bool, time.Time, error) {
+	paused, until := c.history.pauseState()
+	return paused, until, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ClipboardBackend abstracts the system clipboard so that the history
+// doesn't need to know which tools are used to talk to it.
+type ClipboardBackend interface {
+	// Types returns the mime types offered by the current clipboard content.
+	Types() ([]string, error)
+	// Read returns the clipboard content for the given mime type.
+	// If mimeType is empty the backend picks a text type.
+	Read(mimeType string) ([]byte, error)
+	// Write sets the clipboard content and offers it with the given
+	// mime types.
+	Write(data []byte, mimeTypes ...string) error
+	// Watch returns a watcher that reports clipboard changes.
+	// If poll is true the watcher polls the clipboard instead.
+	Watch(poll bool) *Watcher
+}
+
+// NewClipboardBackend returns the clipboard backend with the given name.
+// "auto" picks wayland or x11 depending on the current session.
+func NewClipboardBackend(name string) (ClipboardBackend, error) {
+	switch name {
+	case "wayland":
+		return &WaylandClipboard{}, nil
+	case "x11":
+		return NewX11Clipboard()
+	case "fake":
+		return NewFakeClipboard(), nil
+	case "", "auto":
+		if os.Getenv("WAYLAND_DISPLAY") == "" && os.Getenv("DISPLAY") != "" {
+			return NewX11Clipboard()
+		}
+		return &WaylandClipboard{}, nil
+	}
+
+	return nil, errors.New("Unknown clipboard backend: " + name)
+}
+
+// WaylandClipboard talks to the clipboard through wl-clipboard.
+type WaylandClipboard struct{}
+
+func (c *WaylandClipboard) Types() ([]string, error) {
+	out, err := exec.Command("wl-paste", "--list-types").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return splitLines(out), nil
+}
+
+func (c *WaylandClipboard) Read(mimeType string) ([]byte, error) {
+	args := []string{"--no-newline"}
+	if mimeType != "" {
+		args = append(args, "--type", mimeType)
+	}
+
+	return exec.Command("wl-paste", args...).Output()
+}
+
+// Write copies data to the clipboard. wl-copy can only offer a single
+// mime type, so only the first one is used.
+func (c *WaylandClipboard) Write(data []byte, mimeTypes ...string) error {
+	args := []string{"--foreground"}
+	if len(mimeTypes) > 0 {
+		args = append(args, "--type", mimeTypes[0])
+	}
+
+	// wl-copy stays in the foreground until the clipboard is taken over
+	// by something else, so we don't wait for it
+	return pipeToCommand(exec.Command("wl-copy", args...), data, false)
+}
+
+func (c *WaylandClipboard) Watch(poll bool) *Watcher {
+	// echo doesn't consume the clipboard content, it merely prints
+	// a line for every change which is all we need
+	return NewWatcher([]string{"wl-paste", "--watch", "echo"}, poll)
+}
+
+// X11Clipboard talks to the clipboard through xclip or, if xclip
+// isn't installed, xsel.
+type X11Clipboard struct {
+	tool string
+}
+
+func NewX11Clipboard() (*X11Clipboard, error) {
+	for _, tool := range []string{"xclip", "xsel"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return &X11Clipboard{tool: tool}, nil
+		}
+	}
+
+	return nil, errors.New("Neither xclip nor xsel could be found")
+}
+
+func (c *X11Clipboard) Types() ([]string, error) {
+	// xsel doesn't know anything about targets
+	if c.tool == "xsel" {
+		return []string{"text/plain"}, nil
+	}
+
+	out, err := exec.Command(
+		"xclip", "-selection", "clipboard", "-o", "-t", "TARGETS",
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return splitLines(out), nil
+}
+
+func (c *X11Clipboard) Read(mimeType string) ([]byte, error) {
+	if c.tool == "xsel" {
+		return exec.Command("xsel", "--clipboard", "--output").Output()
+	}
+
+	args := []string{"-selection", "clipboard", "-o"}
+	if mimeType != "" {
+		args = append(args, "-t", mimeType)
+	}
+
+	return exec.Command("xclip", args...).Output()
+}
+
+// Write copies data to the clipboard. Both xclip and xsel can only offer
+// a single mime type, so only the first one is used.
+func (c *X11Clipboard) Write(data []byte, mimeTypes ...string) error {
+	if c.tool == "xsel" {
+		return pipeToCommand(
+			exec.Command("xsel", "--clipboard", "--input"), data, true,
+		)
+	}
+
+	args := []string{"-selection", "clipboard", "-i"}
+	if len(mimeTypes) > 0 {
+		args = append(args, "-t", mimeTypes[0])
+	}
+
+	// xclip forks itself into the background once it has read stdin
+	return pipeToCommand(exec.Command("xclip", args...), data, true)
+}
+
+// Watch always polls since neither xclip nor xsel are able to report
+// clipboard changes.
+func (c *X11Clipboard) Watch(_ bool) *Watcher {
+	return NewWatcher(nil, true)
+}
+
+// FakeClipboard is an in-memory clipboard which doesn't need
+// a running compositor or X server.
+type FakeClipboard struct {
+	mu      sync.Mutex
+	types   []string
+	content map[string][]byte
+	watcher *Watcher
+}
+
+func NewFakeClipboard() *FakeClipboard {
+	return &FakeClipboard{
+		content: map[string][]byte{},
+		watcher: NewWatcher(nil, false),
+	}
+}
+
+func (c *FakeClipboard) Types() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.types), nil
+}
+
+// Read returns the content offered for the mime type. Like wl-paste it
+// picks a text type if mimeType is empty, or the first type if there's
+// no text.
+func (c *FakeClipboard) Read(mimeType string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mimeType == "" && len(c.types) > 0 {
+		mimeType = c.types[0]
+		for _, t := range c.types {
+			if strings.HasPrefix(t, "text/plain") || t == "UTF8_STRING" {
+				mimeType = t
+				break
+			}
+		}
+	}
+
+	data, ok := c.content[mimeType]
+	if !ok {
+		return nil, errors.New("No content for mime type " + mimeType)
+	}
+
+	return bytes.Clone(data), nil
+}
+
+// Write replaces the clipboard content, offering the same data with
+// every mime type, and notifies the watcher.
+func (c *FakeClipboard) Write(data []byte, mimeTypes ...string) error {
+	if len(mimeTypes) == 0 {
+		mimeTypes = []string{"text/plain"}
+	}
+
+	content := map[string][]byte{}
+	for _, mimeType := range mimeTypes {
+		content[mimeType] = data
+	}
+
+	return c.Offer(mimeTypes, content)
+}
+
+// Offer replaces the clipboard content with a different content per
+// mime type, offered in the order of mimeTypes, and notifies the
+// watcher. This is what apps do e.g. to offer a password manager hint
+// or the source url along with the text.
+func (c *FakeClipboard) Offer(mimeTypes []string, content map[string][]byte) error {
+	c.mu.Lock()
+	c.types = slices.Clone(mimeTypes)
+	c.content = map[string][]byte{}
+	for _, mimeType := range mimeTypes {
+		c.content[mimeType] = bytes.Clone(content[mimeType])
+	}
+	c.mu.Unlock()
+
+	c.watcher.notify()
+
+	return nil
+}
+
+func (c *FakeClipboard) Watch(_ bool) *Watcher {
+	return c.watcher
+}
+
+// pipeToCommand starts cmd and writes data to its stdin. The data is
+// always written and stdin closed before returning, so that the caller
+// may exit right away. If wait is false the command is reaped in the
+// background, e.g. wl-copy which keeps running to serve the clipboard.
+func pipeToCommand(cmd *exec.Cmd, data []byte, wait bool) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(stdin, bytes.NewReader(data))
+	stdin.Close()
+
+	if err != nil {
+		// don't leave the command serving a partial content
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	if !wait {
+		go cmd.Wait()
+		return nil
+	}
+
+	return cmd.Wait()
+}
+
+func splitLines(out []byte) []string {
+	lines := []string{}
+	for line := range strings.SplitSeq(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
@@ -27,6 +27,22 @@ const (
 	ImagePreview
 	PreviewWidth
 	ShowPreview
+	Poll
+	Backend
+	Socket
+	SearchMode
+	IgnoreCase
+	CloseOnBlur
+	Fsync
+	KeyFile
+	KeyCommand
+	PasswordManagerHint
+	EphemeralTimeout
+	SecretAction
+	SecretDetectors
+	IncludeApps
+	ExcludeApps
+	ExcludeUrls
 )
 
 type Option struct {
@@ -35,17 +51,33 @@ type Option struct {
 }
 
 var options = map[ConfigOption]Option{
-	SystemTheme:    {"system-theme", flagSystemTheme},
-	MaxEntries:     {"max-entries", *flagMaxEntries},
-	LayerShell:     {"layer-shell", *flagLayerShell},
-	Silent:         {"silent", *flagSilent},
-	Icons:          {"icons", *flagIcons},
-	TextPreviewLen: {"text-preview-length", *flagTextPreviewLength},
-	ImageSupport:   {"image-support", *flagImageSupport},
-	ImageHeight:    {"image-height", *flagImageHeight},
-	ImagePreview:   {"image-preview", *flagImagePreview},
-	PreviewWidth:   {"preview-width", *flagPreviewWidth},
-	ShowPreview:    {"show-preview", *flagShowPreview},
+	SystemTheme:         {"system-theme", flagSystemTheme},
+	MaxEntries:          {"max-entries", *flagMaxEntries},
+	LayerShell:          {"layer-shell", *flagLayerShell},
+	Silent:              {"silent", *flagSilent},
+	Icons:               {"icons", *flagIcons},
+	TextPreviewLen:      {"text-preview-length", *flagTextPreviewLength},
+	ImageSupport:        {"image-support", *flagImageSupport},
+	ImageHeight:         {"image-height", *flagImageHeight},
+	ImagePreview:        {"image-preview", *flagImagePreview},
+	PreviewWidth:        {"preview-width", *flagPreviewWidth},
+	ShowPreview:         {"show-preview", *flagShowPreview},
+	Poll:                {"poll", *flagPoll},
+	Backend:             {"backend", *flagBackend},
+	Socket:              {"socket", *flagSocket},
+	SearchMode:          {"search-mode", *flagSearchMode},
+	IgnoreCase:          {"ignore-case", *flagIgnoreCase},
+	CloseOnBlur:         {"close-on-blur", *flagCloseOnBlur},
+	Fsync:               {"fsync", *flagFsync},
+	KeyFile:             {"key-file", *flagKeyFile},
+	KeyCommand:          {"key-command", *flagKeyCommand},
+	PasswordManagerHint: {"password-manager-hint", *flagPasswordManagerHint},
+	EphemeralTimeout:    {"ephemeral-timeout", *flagEphemeralTimeout},
+	SecretAction:        {"secret-action", *flagSecretAction},
+	SecretDetectors:     {"secret-detectors", *flagSecretDetectors},
+	IncludeApps:         {"include-apps", *flagIncludeApps},
+	ExcludeApps:         {"exclude-apps", *flagExcludeApps},
+	ExcludeUrls:         {"exclude-urls", *flagExcludeUrls},
 }
 
 func (o ConfigOption) String() string {
@@ -92,11 +124,13 @@ func (c *Config) read() error {
 			}
 		}
 
-		ln := strings.Split(string(line), "=")
-		key := strings.TrimSpace(ln[0])
-		val := strings.TrimSpace(ln[1])
+		// only the first = separates the key, values like shell commands
+		// may contain more
+		key, val, ok := strings.Cut(string(line), "=")
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
 
-		if !strings.HasPrefix(key, "#") {
+		if ok && !strings.HasPrefix(key, "#") {
 			c.values[key] = val
 		}
 	}
@@ -125,6 +159,16 @@ func (c *Config) IntVal(opt ConfigOption, defaultVal int) int {
 	return defaultVal
 }
 
+func (c *Config) StringVal(opt ConfigOption, defaultVal string) string {
+	val, ok := c.values[opt.String()]
+
+	if ok && !IsFlagPassed(options[opt].key) {
+		return val
+	}
+
+	return defaultVal
+}
+
 // ConfigDir returns the config directory
 func ConfigDir() (string, error) {
 	ConfigDir, err := os.UserConfigDir()
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigRead(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config")
+	config := "max-entries = 50\n" +
+		"# key-command = commented\n" +
+		"\n" +
+		"key-command = secret-tool lookup service=bbclip user=me\n"
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{file: file, values: map[string]string{}}
+	if err := conf.read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := conf.IntVal(MaxEntries, 0); got != 50 {
+		t.Errorf("max-entries = %d, want 50", got)
+	}
+	want := "secret-tool lookup service=bbclip user=me"
+	if got := conf.StringVal(KeyCommand, ""); got != want {
+		t.Errorf("key-command = %q, want %q", got, want)
+	}
+}
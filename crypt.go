@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The history can be encrypted with AES-256-GCM. The key is derived from
+// a passphrase with PBKDF2, the passphrase is either entered when the
+// history is unlocked or read from the configured key file or command,
+// e.g. `secret-tool lookup app bbclip`.
+//
+// An encrypted history file is an encryptedHistory with the encrypted
+// history as data. Every record of the journal is encrypted separately
+// with the same key. Until the history is unlocked it's empty and no
+// entries are added.
+//
+// A process that knows the key only accepts an unencrypted history file
+// if it was decrypted on purpose. The decrypting process proves that it
+// knew the key with a marker file containing the salt sealed with it.
+
+// Parameters of the encryption
+const (
+	historyCipher      = "aes-256-gcm"
+	historyKDF         = "pbkdf2-sha256"
+	kdfIterations      = 600000
+	kdfSaltSize        = 16
+	historyKeySize     = 32
+	historyDataLabel   = "bbclip history"
+	journalDataLabel   = "bbclip journal"
+	decryptedDataLabel = "bbclip decrypted"
+)
+
+// ErrHistoryLocked is returned if the history is encrypted and hasn't
+// been unlocked
+var ErrHistoryLocked = errors.New("History is locked")
+
+// errUnencryptedRecord is returned for an unencrypted record of an
+// encrypted journal
+var errUnencryptedRecord = errors.New("Unencrypted record in encrypted journal")
+
+// ErrHistoryUnencrypted is returned if an encrypted history file was
+// replaced by an unencrypted one without being decrypted
+var ErrHistoryUnencrypted = errors.New("Encrypted history was replaced by an unencrypted file")
+
+// encryptedHistory is the on-disk representation of an encrypted history
+type encryptedHistory struct {
+	Version    int    `json:"version"`
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// encryptedRecord is an encrypted journal record
+type encryptedRecord struct {
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// historyKey is the key the history is encrypted with
+type historyKey struct {
+	aead       cipher.AEAD
+	salt       []byte
+	iterations int
+}
+
+// newHistoryKey derives the key from the passphrase
+func newHistoryKey(passphrase string, salt []byte, iterations int) (*historyKey, error) {
+	if passphrase == "" {
+		return nil, errors.New("Missing passphrase")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, historyKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &historyKey{aead: aead, salt: salt, iterations: iterations}, nil
+}
+
+// seal encrypts and authenticates the data. The label binds the data to
+// its purpose, so that e.g. a journal record can't be passed off as
+// history file.
+func (k *historyKey) seal(data []byte, label string) (nonce []byte, sealed []byte, err error) {
+	nonce = make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, k.aead.Seal(nil, nonce, data, []byte(label)), nil
+}
+
+func (k *historyKey) open(nonce []byte, sealed []byte, label string) ([]byte, error) {
+	if len(nonce) != k.aead.NonceSize() {
+		return nil, errors.New("Invalid nonce")
+	}
+
+	return k.aead.Open(nil, nonce, sealed, []byte(label))
+}
+
+// encryptHistory encrypts the encoded history file
+func (k *historyKey) encryptHistory(data []byte) ([]byte, error) {
+	nonce, sealed, err := k.seal(data, historyDataLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedHistory{
+		Version:    historyVersion,
+		Cipher:     historyCipher,
+		KDF:        historyKDF,
+		Iterations: k.iterations,
+		Salt:       k.salt,
+		Nonce:      nonce,
+		Data:       sealed,
+	})
+}
+
+// parseEncryptedHistory returns the encrypted history if data is one
+func parseEncryptedHistory(data []byte) (*encryptedHistory, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil, false
+	}
+
+	var file encryptedHistory
+	if err := json.Unmarshal(data, &file); err != nil || file.Cipher == "" {
+		return nil, false
+	}
+
+	return &file, true
+}
+
+// decode decodes the content of a history file, decrypting it with the
+// key of the history if it's encrypted, and raises the last id to the
+// one recorded in the file. ErrHistoryLocked is returned
+// if the history has no key for the file, ErrHistoryUnencrypted if it
+// has a key but the file isn't encrypted. The caller must hold the lock.
+func (h *History) decode(data []byte) ([]HistoryEntry, error) {
+	file, ok := parseEncryptedHistory(data)
+	if !ok && h.key != nil {
+		return []HistoryEntry{}, ErrHistoryUnencrypted
+	}
+	if !ok {
+		return h.decodeEntries(data)
+	}
+
+	if file.Cipher != historyCipher || file.KDF != historyKDF {
+		return []HistoryEntry{}, fmt.Errorf(
+			"Unsupported history encryption %s with %s", file.Cipher, file.KDF,
+		)
+	}
+
+	// the history may have been encrypted with another passphrase
+	// by a different process
+	if h.key == nil || !bytes.Equal(h.key.salt, file.Salt) {
+		return []HistoryEntry{}, ErrHistoryLocked
+	}
+
+	data, err := h.key.open(file.Nonce, file.Data, historyDataLabel)
+	if err != nil {
+		return []HistoryEntry{}, fmt.Errorf("Could not decrypt history: %w", err)
+	}
+
+	return h.decodeEntries(data)
+}
+
+// decodeEntries decodes the unencrypted history file and raises the last
+// id to the one recorded in it. The caller must hold the lock.
+func (h *History) decodeEntries(data []byte) ([]HistoryEntry, error) {
+	entries, lastID, err := decodeHistory(data)
+	if err == nil {
+		h.lastID = max(h.lastID, lastID)
+	}
+
+	return entries, err
+}
+
+// encryptRecord encrypts the encoded journal record
+func (k *historyKey) encryptRecord(data []byte) ([]byte, error) {
+	nonce, sealed, err := k.seal(data, journalDataLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedRecord{Nonce: nonce, Data: sealed})
+}
+
+// decryptRecord returns the decrypted journal record if line is an
+// encrypted one and line itself otherwise. Without a key only unencrypted
+// records are accepted and vice versa.
+func (k *historyKey) decryptRecord(line []byte) ([]byte, error) {
+	var record encryptedRecord
+	if err := json.Unmarshal(line, &record); err != nil || record.Data == nil {
+		// anybody could have appended an unencrypted record
+		if k != nil {
+			return nil, errUnencryptedRecord
+		}
+		return line, nil
+	}
+
+	if k == nil {
+		return nil, ErrHistoryLocked
+	}
+
+	return k.open(record.Nonce, record.Data, journalDataLabel)
+}
+
+// isLocked returns whether the history is encrypted and hasn't been
+// unlocked yet
+func (h *History) isLocked() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.locked
+}
+
+// isEncrypted returns whether the history is stored encrypted
+func (h *History) isEncrypted() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.locked || h.key != nil
+}
+
+// Unlock decrypts the history with the key derived from the passphrase
+// and loads its entries.
+func (h *History) Unlock(passphrase string) error {
+	h.lock()
+	defer h.unlock()
+
+	return h.unlockWith(passphrase)
+}
+
+// unlockWith unlocks the history, the caller must hold both locks.
+func (h *History) unlockWith(passphrase string) error {
+	if !h.locked {
+		return errors.New("History is not locked")
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+
+	file, ok := parseEncryptedHistory(data)
+	if !ok {
+		// decrypted by another process in the meantime
+		h.reload()
+		return nil
+	}
+
+	key, err := newHistoryKey(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+
+	if _, err := key.open(file.Nonce, file.Data, historyDataLabel); err != nil {
+		return errors.New("Wrong passphrase")
+	}
+
+	h.key = key
+	h.reload()
+
+	return nil
+}
+
+// unlockWithKeySource unlocks the history with the passphrase of the
+// configured key file or command. The caller must hold both locks.
+func (h *History) unlockWithKeySource() error {
+	passphrase, ok, err := keySourcePassphrase(h.conf)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrHistoryLocked
+	}
+
+	return h.unlockWith(passphrase)
+}
+
+// Lock forgets the key and the entries of an encrypted history
+func (h *History) Lock() error {
+	h.lock()
+	defer h.unlock()
+
+	if h.locked {
+		return nil
+	}
+
+	if h.key == nil {
+		return errors.New("History is not encrypted")
+	}
+
+	h.key = nil
+	// read the file again, which fails without key
+	h.snapshot = nil
+	h.reload()
+
+	return nil
+}
+
+// Encrypt encrypts the history with a key derived from the passphrase.
+// The backups of the unencrypted history are removed. The unencrypted
+// copies of damaged history files, see recover, are left in place for
+// the user to decide and returned.
+func (h *History) Encrypt(passphrase string) (damaged []string, err error) {
+	h.lock()
+	defer h.unlock()
+
+	if h.locked {
+		return nil, ErrHistoryLocked
+	}
+
+	if h.key != nil {
+		return nil, errors.New("History is already encrypted")
+	}
+
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := newHistoryKey(passphrase, salt, kdfIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	h.key = key
+	if err := h.Save(); err != nil {
+		h.key = nil
+		return nil, err
+	}
+
+	os.Remove(decryptedPath(h.path))
+	for i := 1; i <= historyBackups; i++ {
+		os.Remove(backupPath(h.path, i))
+	}
+
+	damaged, _ = filepath.Glob(h.path + ".damaged-*")
+
+	return damaged, nil
+}
+
+// Decrypt stores the history unencrypted again
+func (h *History) Decrypt() error {
+	h.lock()
+	defer h.unlock()
+
+	if h.locked {
+		return ErrHistoryLocked
+	}
+
+	if h.key == nil {
+		return errors.New("History is not encrypted")
+	}
+
+	// the marker has to exist before the unencrypted file does
+	if err := h.key.markDecrypted(h.path); err != nil {
+		return err
+	}
+
+	key := h.key
+	h.key = nil
+	if err := h.Save(); err != nil {
+		h.key = key
+		os.Remove(decryptedPath(h.path))
+		return err
+	}
+
+	h.decryptBackups(key)
+
+	return nil
+}
+
+// decryptBackups stores the encrypted backups unencrypted, otherwise
+// the history couldn't be recovered from them without the key anymore.
+// The caller must hold both locks.
+func (h *History) decryptBackups(key *historyKey) {
+	for i := 1; i <= historyBackups; i++ {
+		path := backupPath(h.path, i)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		file, ok := parseEncryptedHistory(data)
+		if !ok || !bytes.Equal(file.Salt, key.salt) {
+			continue
+		}
+
+		data, err = key.open(file.Nonce, file.Data, historyDataLabel)
+		if err != nil {
+			continue
+		}
+
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			println("Could not decrypt history backup:", err.Error())
+			continue
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			println("Could not decrypt history backup:", err.Error())
+		}
+	}
+}
+
+// decryptedPath returns the path of the marker written by Decrypt
+func decryptedPath(path string) string {
+	return path + ".decrypted"
+}
+
+// markDecrypted writes the marker that tells other processes knowing
+// the key that the history at path was decrypted on purpose
+func (k *historyKey) markDecrypted(path string) error {
+	nonce, sealed, err := k.seal(k.salt, decryptedDataLabel)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(encryptedRecord{Nonce: nonce, Data: sealed})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(decryptedPath(path), data, 0600)
+}
+
+// decrypted returns whether the history at path was decrypted on purpose
+// by a process knowing the key, see markDecrypted
+func (k *historyKey) decrypted(path string) bool {
+	data, err := os.ReadFile(decryptedPath(path))
+	if err != nil {
+		return false
+	}
+
+	var marker encryptedRecord
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return false
+	}
+
+	salt, err := k.open(marker.Nonce, marker.Data, decryptedDataLabel)
+
+	return err == nil && bytes.Equal(salt, k.salt)
+}
+
+// keySourcePassphrase returns the passphrase read from the configured
+// key file or printed by the configured key command. ok is false if
+// neither is configured.
+func keySourcePassphrase(conf *Config) (passphrase string, ok bool, err error) {
+	if file := conf.StringVal(KeyFile, *flagKeyFile); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, err
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+
+	if command := conf.StringVal(KeyCommand, *flagKeyCommand); command != "" {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", false, fmt.Errorf("Key command failed: %w", err)
+		}
+
+		return strings.TrimRight(string(out), "\r\n"), true, nil
+	}
+
+	return "", false, nil
+}
+
+// readPassphrase reads the passphrase from the terminal without echoing
+// it, or from stdin if it's not a terminal.
+func readPassphrase(prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			defer func() {
+				stty := exec.Command("stty", "echo")
+				stty.Stdin = os.Stdin
+				stty.Run()
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("Missing passphrase")
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
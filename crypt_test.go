@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	h := newTestHistory(t)
+
+	if err := h.add(NewHistoryEntry("first secret", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Encrypt("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.add(NewHistoryEntry("second secret", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{h.path, journalPath(h.path)} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("%s isn't encrypted", path)
+		}
+	}
+
+	other := reopen(h)
+	if !other.isLocked() || len(other.list()) > 0 {
+		t.Fatal("history isn't locked without passphrase")
+	}
+	if err := other.add(NewHistoryEntry("while locked", nil, time.Now())); !errors.Is(err, ErrHistoryLocked) {
+		t.Errorf("add while locked = %v, want %v", err, ErrHistoryLocked)
+	}
+
+	if err := other.Unlock("wrong passphrase"); err == nil {
+		t.Fatal("history was unlocked with a wrong passphrase")
+	}
+	if err := other.Unlock("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"first secret", "second secret"}
+	if got := texts(other.entries); !slices.Equal(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+
+	if err := other.Decrypt(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("second secret")) {
+		t.Error("history wasn't decrypted")
+	}
+
+	// the first process drops its key once it notices the decryption
+	if err := h.add(NewHistoryEntry("third", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if h.isEncrypted() {
+		t.Error("history is still encrypted by the other process")
+	}
+
+	want = append(want, "third")
+	if got := texts(reopen(h).entries); !slices.Equal(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestEncryptedHistoryRejectsUnencryptedData(t *testing.T) {
+	h := newTestHistory(t)
+
+	if err := h.add(NewHistoryEntry("one", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Encrypt("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	injected := journalRecord(t, EntryAdded, textEntry(100, "injected record"))
+	f, err := os.OpenFile(journalPath(h.path), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(injected)
+	f.Close()
+
+	if err := h.add(NewHistoryEntry("two", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(h.entries); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("entries = %v, want [one two]", got)
+	}
+
+	// the records after the injected one are still replayed
+	other := reopen(h)
+	if err := other.Unlock("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(other.entries); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("replayed entries = %v, want [one two]", got)
+	}
+
+	// a replaced history file doesn't downgrade the encryption
+	plain, err := encodeHistory([]HistoryEntry{textEntry(101, "injected file")}, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.path, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.add(NewHistoryEntry("three", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isEncrypted() {
+		t.Fatal("history was downgraded by an unencrypted file")
+	}
+	if got := texts(h.entries); !slices.Equal(got, []string{"one", "two", "three"}) {
+		t.Errorf("entries = %v, want [one two three]", got)
+	}
+
+	data, err := os.ReadFile(journalPath(h.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("three")) {
+		t.Error("new entry was written unencrypted")
+	}
+}
+
+func TestDecryptRecord(t *testing.T) {
+	key, err := newHistoryKey("passphrase", []byte("salt"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newHistoryKey("other", []byte("salt"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte(`{"kind":"added"}`)
+	encrypted, err := key.encryptRecord(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     *historyKey
+		line    []byte
+		wantErr bool
+	}{
+		{name: "unencrypted", key: nil, line: plain},
+		{name: "encrypted", key: key, line: encrypted},
+		{name: "unencrypted with key", key: key, line: plain, wantErr: true},
+		{name: "encrypted without key", key: nil, line: encrypted, wantErr: true},
+		{name: "other key", key: other, line: encrypted, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.decryptRecord(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decryptRecord() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, plain) {
+				t.Errorf("decryptRecord() = %s, want %s", got, plain)
+			}
+		})
+	}
+}
+
+func TestEncryptedHistoryLabels(t *testing.T) {
+	key, err := newHistoryKey("passphrase", []byte("salt"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a journal record can't be passed off as history file
+	record, err := key.encryptRecord([]byte(`{"version":2,"entries":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := key.encryptHistory([]byte(`{"version":2,"entries":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, ok := parseEncryptedHistory(file)
+	if !ok {
+		t.Fatal("encrypted history wasn't recognized")
+	}
+	if _, err := key.open(parsed.Nonce, parsed.Data, journalDataLabel); err == nil {
+		t.Error("history file was opened as journal record")
+	}
+	if _, err := key.decryptRecord(record); err != nil {
+		t.Error(err)
+	}
+	if _, ok := parseEncryptedHistory([]byte(`{"version":2,"entries":[]}`)); ok {
+		t.Error("unencrypted history was taken for an encrypted one")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runDaemon collects the clipboard history and serves it on the socket
+// without any user interface. Commands that control the window are
+// forwarded to the user interface if one is running. Returns the exit
+// code.
+func runDaemon() int {
+	conf := NewConfig()
+	path := SocketPath(conf)
+
+	history, err := OpenHistory(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	server := NewSocketServer(path, history)
+	for _, cmd := range []string{"SHOW", "HIDE", "TOGGLE"} {
+		server.Handle(cmd, forwardToUi(uiSocketPath(path), cmd))
+	}
+
+	// pass the changes on to the user interface so that it can update
+	// the list while it's visible. The queue keeps them in order and
+	// never blocks the history, which is locked while it notifies.
+	changes := newChangeQueue()
+	history.Subscribe(changes.push)
+	go forwardChanges(uiSocketPath(path), changes)
+
+	if err := server.Listen(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer server.Close()
+
+	history.Init()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	return 0
+}
+
+// forwardToUi returns a handler that sends the command to the user
+// interface listening on path.
+func forwardToUi(path string, cmd string) CommandHandler {
+	return func(_ string) Response {
+		_, _, err := SocketRequest(path, cmd)
+
+		if errors.Is(err, ErrNotRunning) {
+			return errorResponse(CodeUnavailable, "No user interface running")
+		}
+
+		return resultResponse(err)
+	}
+}
+
+// forwardTimeout is how long the user interface may take to accept a
+// forwarded change
+const forwardTimeout = 2 * time.Second
+
+// forwardChanges sends every change as CHANGED command to the user
+// interface listening on path. Changes are dropped if no user interface
+// is running. If it doesn't answer the changes queued so far are dropped
+// as well, the user interface reloads the list when it's shown.
+func forwardChanges(path string, changes *changeQueue) {
+	for {
+		for _, change := range changes.pop() {
+			data, err := json.Marshal(change.stored())
+			if err != nil {
+				fmt.Println("Could not encode change:", err)
+				continue
+			}
+
+			_, _, err = SocketRequestTimeout(path, "CHANGED "+string(data), forwardTimeout)
+			if errors.Is(err, ErrNotRunning) {
+				continue
+			}
+			if err != nil {
+				fmt.Println("Could not forward change:", err)
+				break
+			}
+		}
+	}
+}
+
+// changeQueue is an unbounded queue of history changes
+type changeQueue struct {
+	mu      sync.Mutex
+	changes []HistoryChange
+	// ready receives a value whenever changes were pushed
+	ready chan struct{}
+}
+
+func newChangeQueue() *changeQueue {
+	return &changeQueue{ready: make(chan struct{}, 1)}
+}
+
+// push appends the change to the queue without blocking
+func (q *changeQueue) push(change HistoryChange) {
+	q.mu.Lock()
+	q.changes = append(q.changes, change)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for changes and removes all queued changes from the queue
+func (q *changeQueue) pop() []HistoryChange {
+	<-q.ready
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changes := q.changes
+	q.changes = nil
+
+	return changes
+}
+
+// uiSocketPath returns the path of the socket the user interface
+// listens on when the history is collected by the daemon.
+func uiSocketPath(path string) string {
+	return strings.TrimSuffix(path, ".sock") + "-ui.sock"
+}
@@ -7,6 +7,7 @@ require github.com/gotk3/gotk3 v0.6.5-0.20240618185848-ff349ae13f56
 require (
 	github.com/adrg/xdg v0.5.3
 	github.com/dlasky/gotk3-layershell v0.0.0-20240515133811-5c5115f0d774
+	golang.org/x/text v0.28.0
 )
 
 require golang.org/x/sys v0.35.0 // indirect
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
-	"os/exec"
 	"slices"
 	"sync"
 	"time"
@@ -17,6 +18,25 @@ import (
 
 const HistoryFile = "org.pgml.bbclip-hist"
 
+// historyBackups is the number of backups kept of the history file
+const historyBackups = 3
+
+// ErrHistoryRecovered is returned by Read if the history file was
+// damaged and its entries had to be recovered
+var ErrHistoryRecovered = errors.New("History file is damaged")
+
+// Values of the password-manager-hint option, what is done with content
+// that password managers mark as secret
+const (
+	// HintSkip doesn't add secrets to the history
+	HintSkip = "skip"
+	// HintEphemeral adds secrets as ephemeral entries which are never
+	// written to disk and removed after the ephemeral timeout
+	HintEphemeral = "ephemeral"
+	// HintIgnore adds secrets like any other content
+	HintIgnore = "ignore"
+)
+
 type ImageSource int
 
 const (
@@ -32,8 +52,96 @@ type Image struct {
 }
 
 type HistoryEntry struct {
-	str *string
-	img *Image
+	// id uniquely identifies the entry and never changes
+	id       uint64
+	str      *string
+	img      *Image
+	mimeType string
+	size     int64
+	created  time.Time
+	lastUsed time.Time
+	// useCount is how often the entry was copied from the history
+	useCount int
+	pinned   bool
+	// hash identifies the content, see contentHash
+	hash string
+	// ephemeral entries are never persisted and removed once they
+	// have expired
+	ephemeral bool
+	expires   time.Time
+	// secret is the name of the secret detector that matched the
+	// content of a masked entry, see secrets.go
+	secret string
+	// source is where the content was copied from
+	source ClipboardSource
+}
+
+// NewHistoryEntry creates an entry for the given content. The id is
+// assigned once the entry is added to the history.
+func NewHistoryEntry(content string, img *Image, now time.Time) HistoryEntry {
+	entry := HistoryEntry{
+		str:      &content,
+		img:      img,
+		mimeType: "text/plain",
+		size:     int64(len(content)),
+		created:  now,
+		lastUsed: now,
+	}
+
+	if img != nil {
+		entry.mimeType = img.mimeType
+		entry.size = img.size
+	}
+
+	entry.hash = contentHash(entry)
+
+	return entry
+}
+
+// contentHash returns the SHA-256 hash of the image file of an image
+// entry or of the text of any other entry. Images are hashed by their
+// bytes since the same image can be copied from different urls.
+func contentHash(entry HistoryEntry) string {
+	hash := sha256.New()
+
+	if entry.img != nil {
+		if f, err := os.Open(entry.img.path); err == nil {
+			defer f.Close()
+
+			if _, err := io.Copy(hash, f); err == nil {
+				return hex.EncodeToString(hash.Sum(nil))
+			}
+			hash.Reset()
+		}
+	}
+
+	hash.Write([]byte(*entry.str))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ChangeKind is the kind of a HistoryChange
+type ChangeKind string
+
+// Kinds of history changes
+const (
+	EntryAdded ChangeKind = "added"
+	// EntryMoved is sent if an existing entry was moved to the top
+	EntryMoved   ChangeKind = "moved"
+	EntryRemoved ChangeKind = "removed"
+	// EntryUpdated is sent if the metadata of an entry changed, e.g.
+	// it was pinned
+	EntryUpdated ChangeKind = "updated"
+	// PauseChanged is sent if capturing was paused or resumed, the
+	// entry is empty
+	PauseChanged ChangeKind = "paused"
+)
+
+// HistoryChange describes a single change of the history. Entry is the
+// entry after the change.
+type HistoryChange struct {
+	Kind  ChangeKind
+	Entry HistoryEntry
 }
 
 type History struct {
@@ -42,9 +150,48 @@ type History struct {
 	entries    []HistoryEntry
 	path       string
 	conf       *Config
+	watcher    *Watcher
+	clipboard  ClipboardBackend
+	// lastID is the highest id that has been assigned to an entry
+	lastID uint64
+	// hashes maps the content hashes to the entry ids
+	hashes map[string]uint64
+	// positions maps the entry ids to their index in entries
+	positions map[uint64]int
+	// subscribers are called whenever the history has changed
+	subscribers []func(change HistoryChange)
+
+	// journal is the file the changes are appended to, see journal.go
+	journal        *os.File
+	journalRecords int
+	compacting     bool
+	// journalSize is the length of the journal that has been applied
+	// to the entries, see lock.go
+	journalSize int64
+	// snapshot describes the history file the entries were read from
+	snapshot os.FileInfo
+	// key is the key of an encrypted history, see crypt.go
+	key *historyKey
+	// locked is true while the history is encrypted and no key is known
+	locked bool
+	// lockFile is the file that is locked while the history files are
+	// read or written
+	lockFile *os.File
+	// fsync is the fsync policy, one of the Fsync constants
+	fsync string
+	// detectors detect secrets in the captured content
+	detectors []secretDetector
+	// sources decide which sources content is captured from
+	sources sourceRules
+
+	// paused stops capturing the clipboard until pausedUntil or, if
+	// that's zero, until the capture is resumed
+	paused      bool
+	pausedUntil time.Time
+	resumeTimer *time.Timer
 }
 
-func NewHistory(conf *Config) *History {
+func NewHistory(conf *Config, clipboard ClipboardBackend) *History {
 	path := xdg.DataHome + "/" + HistoryFile
 
 	if _, err := os.Stat(path); err != nil {
@@ -62,262 +209,782 @@ func NewHistory(conf *Config) *History {
 		maxEntries: conf.IntVal(MaxEntries, *flagMaxEntries),
 		path:       path,
 		conf:       conf,
+		clipboard:  clipboard,
+		hashes:     make(map[string]uint64),
+		positions:  make(map[uint64]int),
+		fsync:      conf.StringVal(Fsync, *flagFsync),
+		detectors:  newSecretDetectors(conf),
+		sources:    newSourceRules(conf),
 	}
 
-	if *flagClearHistory {
-		history.clear()
-	}
-
-	history.mu.RLock()
+	history.mu.Lock()
+	history.flock()
 	entries, err := history.Read()
 	history.entries = entries
-	history.mu.RUnlock()
+	history.reindex()
+
+	if errors.Is(err, ErrHistoryLocked) {
+		history.locked = true
+		err = history.unlockWithKeySource()
+	}
+
+	// write the recovered entries right away, the damaged file has
+	// been moved aside
+	if errors.Is(err, ErrHistoryRecovered) {
+		if err := history.Save(); err != nil {
+			println("Could not save recovered history:", err.Error())
+		}
+	}
+	history.unlock()
 
 	if err != nil {
-		println(err)
+		println(err.Error())
 	}
 
-	if len(history.entries) > history.maxEntries {
-		exceeds := len(history.entries) - history.maxEntries
-		history.entries = slices.Delete(history.entries, 0, 0+exceeds)
-		history.Save()
+	if *flagClearHistory {
+		history.clear()
 	}
 
+	history.trim()
+
 	history.cleanCache()
 
 	return history
 }
 
+// OpenHistory creates the clipboard backend configured in conf and
+// loads the history.
+func OpenHistory(conf *Config) (*History, error) {
+	clipboard, err := NewClipboardBackend(
+		conf.StringVal(Backend, *flagBackend),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistory(conf, clipboard), nil
+}
+
+// Init starts watching the clipboard and adds every change to the history.
+// Changes other processes make to the history files are merged as well.
 func (h *History) Init() {
+	h.watcher = h.clipboard.Watch(h.conf.BoolVal(Poll, *flagPoll))
+	h.watcher.Start()
+
+	go h.watchFile()
+
 	go func() {
-		ticker := time.NewTicker(300 * time.Millisecond)
-		defer ticker.Stop()
+		for range h.watcher.Events() {
+			h.capture()
+		}
+	}()
+}
 
-		for range ticker.C {
-			out, err := exec.Command("wl-paste", "--no-newline").Output()
-			if err != nil {
-				continue
-			}
+// capture reads the current clipboard content and adds it to the history
+// if it differs from the last entry.
+func (h *History) capture() {
+	if paused, _ := h.pauseState(); paused {
+		return
+	}
 
-			cont := string(bytes.TrimSpace(out))
-			if cont == "" {
-				continue
-			}
+	types, _ := h.clipboard.Types()
 
-			last := ""
-			if len(h.entries) > 0 {
-				last = *h.entries[len(h.entries)-1].str
-			}
+	// don't even read secrets that aren't added anyway
+	sensitive := clipboardIsSensitive(h.clipboard, types)
+	policy := h.conf.StringVal(PasswordManagerHint, *flagPasswordManagerHint)
+	if sensitive && policy == HintSkip {
+		return
+	}
 
-			shouldRefresh := false
-			historyEntry := HistoryEntry{}
-			imageSupport := h.conf.BoolVal(ImageSupport, *flagImageSupport)
-
-			if img, ok := clipboardHasImage(); ok && imageSupport {
-				fileUrl := fileUrl(string(cont), &img)
-
-				if fileUrl != last {
-					if img.source == ImageSrcBrowser {
-						p, _ := downloadImage(img.path)
-						img.path = p
-					}
-					historyEntry.str = &fileUrl
-					historyEntry.img = &img
-					shouldRefresh = true
-				}
-			} else {
-				if cont != last {
-					historyEntry.str = &cont
-					shouldRefresh = true
-				}
-			}
+	out, err := h.clipboard.Read("")
+	if err != nil {
+		return
+	}
 
-			if shouldRefresh {
-				h.mu.Lock()
+	cont := string(bytes.TrimSpace(out))
+	if cont == "" || h.isLocked() {
+		return
+	}
 
-				if ok, index := h.contains(cont); ok {
-					h.entries = slices.Delete(h.entries, index, index+1)
-				}
+	last := ""
+	if entry, ok := h.last(); ok {
+		last = *entry.str
+	}
 
-				h.entries = append(h.entries, historyEntry)
+	imageSupport := h.conf.BoolVal(ImageSupport, *flagImageSupport)
+	img, isImage := clipboardHasImage(types)
+	isImage = isImage && imageSupport
 
-				if err := h.Save(); err != nil {
-					println("Could not save to clipboard history:", err)
-				}
+	content := cont
+	if isImage {
+		content = fileUrl(cont, &img)
+	}
+
+	if content == last {
+		return
+	}
+
+	// the source is checked before anything is done with the content,
+	// e.g. downloading an image copied from an excluded page
+	source := resolveSource(h.clipboard, types)
+	if !h.sources.allows(source) {
+		return
+	}
 
-				h.mu.Unlock()
+	var historyEntry HistoryEntry
+	if isImage {
+		if img.source == ImageSrcBrowser {
+			p, _ := downloadImage(img.path)
+			img.path = p
+		}
+		if u, err := url.Parse(content); err == nil && img.path == "" {
+			img.path = u.Path
+		}
+		if f, err := os.Stat(img.path); err == nil {
+			img.size = f.Size()
+		}
+		historyEntry = NewHistoryEntry(content, &img, time.Now())
+	} else {
+		historyEntry = NewHistoryEntry(cont, nil, time.Now())
+	}
+	historyEntry.source = source
+
+	ephemeral := sensitive && policy == HintEphemeral
+
+	if historyEntry.img == nil {
+		if name := detectSecret(h.detectors, cont); name != "" {
+			switch h.conf.StringVal(SecretAction, *flagSecretAction) {
+			case SecretDrop:
+				return
+			case SecretMask:
+				historyEntry.secret = name
+			case SecretExpire:
+				ephemeral = true
 			}
 		}
-	}()
+	}
+
+	if ephemeral {
+		timeout := h.conf.IntVal(EphemeralTimeout, *flagEphemeralTimeout)
+		historyEntry.ephemeral = true
+		historyEntry.expires = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+
+	if err := h.add(historyEntry); err != nil {
+		println("Could not save to clipboard history:", err)
+	}
+}
+
+// Pause stops capturing the clipboard. If duration isn't zero the
+// capture is resumed automatically after it.
+func (h *History) Pause(duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.resumeTimer != nil {
+		h.resumeTimer.Stop()
+		h.resumeTimer = nil
+	}
+
+	h.paused = true
+	h.pausedUntil = time.Time{}
+
+	if duration > 0 {
+		until := time.Now().Add(duration)
+		h.pausedUntil = until
+		h.resumeTimer = time.AfterFunc(duration, func() {
+			h.resumeAfter(until)
+		})
+	}
+
+	h.notify(PauseChanged, HistoryEntry{str: new(string)})
+}
+
+// Resume continues capturing the clipboard
+func (h *History) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.resume()
 }
 
+// resumeAfter ends the pause that lasts until the given time. The timer
+// may fire after the pause was replaced by another one, that one is left
+// alone.
+func (h *History) resumeAfter(until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.paused && h.pausedUntil.Equal(until) {
+		h.resume()
+	}
+}
+
+// resume ends the pause. The caller must hold the lock.
+func (h *History) resume() {
+	if h.resumeTimer != nil {
+		h.resumeTimer.Stop()
+		h.resumeTimer = nil
+	}
+
+	if !h.paused {
+		return
+	}
+
+	h.paused = false
+	h.pausedUntil = time.Time{}
+
+	h.notify(PauseChanged, HistoryEntry{str: new(string)})
+}
+
+// pauseState returns whether capturing is paused and until when. until
+// is zero if it's paused until it's resumed.
+func (h *History) pauseState() (paused bool, until time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.paused, h.pausedUntil
+}
+
+// add adds the entry to the top of the history. If an entry with the
+// same content already exists it is moved to the top instead.
+func (h *History) add(historyEntry HistoryEntry) error {
+	h.lock()
+	defer h.unlock()
+
+	if h.locked {
+		return ErrHistoryLocked
+	}
+
+	kind := EntryAdded
+	moved := len(h.entries)
+
+	if index := h.indexOfHash(historyEntry.hash); index >= 0 {
+		// keep the identity and metadata of the existing entry
+		prev := h.entries[index]
+		historyEntry.id = prev.id
+		historyEntry.created = prev.created
+		historyEntry.useCount = prev.useCount
+		historyEntry.pinned = prev.pinned
+		// content that is already persisted stays persisted
+		historyEntry.ephemeral = historyEntry.ephemeral && prev.ephemeral
+		h.entries = slices.Delete(h.entries, index, index+1)
+		kind = EntryMoved
+		moved = index
+	} else {
+		historyEntry.id = h.nextID()
+	}
+
+	h.entries = append(h.entries, historyEntry)
+	h.hashes[historyEntry.hash] = historyEntry.id
+	h.reposition(moved)
+
+	if historyEntry.ephemeral {
+		time.AfterFunc(time.Until(historyEntry.expires), func() {
+			h.expire(historyEntry.id)
+		})
+	}
+
+	return h.commit(kind, historyEntry)
+}
+
+// expire removes the ephemeral entry with the given id if it has expired.
+// It may have been added again in the meantime, in that case it expires
+// later.
+func (h *History) expire(id uint64) {
+	h.lock()
+	defer h.unlock()
+
+	index := h.indexOf(id)
+	if index < 0 {
+		return
+	}
+
+	entry := h.entries[index]
+	if !entry.ephemeral || time.Now().Before(entry.expires) {
+		return
+	}
+
+	if err := h.deleteAt(index); err != nil {
+		println("Could not remove expired entry:", err.Error())
+	}
+}
+
+// Read reads the history file and replays the journal on top of it.
+// Files written in an older format are migrated to the current one.
+// If the file is damaged the entries are recovered as far as possible
+// and an error describing the recovery is returned along with them.
 func (h *History) Read() ([]HistoryEntry, error) {
-	path := xdg.DataHome + "/" + HistoryFile
-	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	data, err := os.ReadFile(h.path)
 
 	if err != nil {
 		return []HistoryEntry{}, err
 	}
-	defer file.Close()
+	h.snapshot, _ = os.Stat(h.path)
+
+	// decrypted by another process, don't encrypt it again
+	if _, encrypted := parseEncryptedHistory(data); !encrypted && h.key != nil && h.key.decrypted(h.path) {
+		h.key = nil
+	}
+
+	entries, readErr := h.decode(data)
+	if errors.Is(readErr, ErrHistoryLocked) || errors.Is(readErr, ErrHistoryUnencrypted) {
+		// the journal can't be read or trusted either
+		return entries, readErr
+	}
+	if readErr != nil {
+		entries, readErr = h.recover(data, readErr)
+	}
+
+	journal, err := os.ReadFile(journalPath(h.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return entries, err
+	}
 
-	var history []string
+	changes, valid := decodeJournal(journal, h.key)
+	for _, change := range changes {
+		entries = applyRecord(entries, change)
+		h.lastID = max(h.lastID, change.Entry.id)
+	}
+	h.journalRecords = len(changes)
+	h.journalSize = int64(valid)
+	h.snapshot, _ = os.Stat(h.path)
+
+	// drop the broken end so that new records aren't appended to it
+	if valid < len(journal) {
+		if err := os.Truncate(journalPath(h.path), int64(valid)); err != nil {
+			return entries, err
+		}
+	}
 
-	err = json.NewDecoder(file).Decode(&history)
+	return entries, readErr
+}
 
+// recover salvages the entries of a damaged history file. If none can be
+// salvaged the most recent readable backup is used. The damaged file is
+// moved aside so that it isn't overwritten by the next Save.
+func (h *History) recover(data []byte, decodeErr error) ([]HistoryEntry, error) {
 	entries := []HistoryEntry{}
-	for _, content := range history {
-		var img *Image = nil
-		if fileUrl, fErr := url.Parse(content); fErr == nil {
-			if fileUrl.Scheme == "file" {
-				if f, err := os.Stat(fileUrl.Path); err == nil {
-					img = &Image{
-						source:   ImageSrcFileSystem,
-						mimeType: "image/*",
-						path:     fileUrl.Path,
-						size:     f.Size(),
-					}
-				}
-			}
+	source := "the damaged file"
+
+	// an encrypted file can't be salvaged partially
+	if h.key == nil {
+		entries = salvageHistory(data)
+	}
+
+	for i := 1; len(entries) == 0 && i <= historyBackups; i++ {
+		backup, err := os.ReadFile(backupPath(h.path, i))
+		if err != nil {
+			continue
 		}
 
-		entries = append(entries, HistoryEntry{
-			str: &content,
-			img: img,
-		})
+		if decoded, err := h.decode(backup); err == nil && len(decoded) > 0 {
+			entries = decoded
+			source = backupPath(h.path, i)
+		}
 	}
 
-	return entries, nil
+	damaged := fmt.Sprintf("%s.damaged-%d", h.path, time.Now().UnixMilli())
+	if err := os.Rename(h.path, damaged); err != nil {
+		return entries, err
+	}
+
+	return entries, fmt.Errorf(
+		"%w (%s), recovered %d entries from %s, the damaged file was moved to %s",
+		ErrHistoryRecovered, decodeErr, len(entries), source, damaged,
+	)
 }
 
+// Save writes all entries to the history file and empties the journal.
+// The file is written to a temporary file first and renamed afterwards
+// so it's never left half written. The previous file is kept as backup.
+// An encrypted history is encrypted with its key.
 func (h *History) Save() error {
-	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_TRUNC, 0644)
+	if h.locked {
+		return ErrHistoryLocked
+	}
 
+	data, err := encodeHistory(h.entries, h.lastID)
 	if err != nil {
-		println(err)
 		return err
 	}
-	defer file.Close()
 
-	entries := []string{}
-	for _, entry := range h.entries {
-		if entry.str == nil {
-			continue
+	if h.key != nil {
+		if data, err = h.key.encryptHistory(data); err != nil {
+			return err
 		}
-		entries = append(entries, *entry.str)
 	}
 
-	return json.NewEncoder(file).Encode(entries)
-}
+	tmp := h.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		println(err)
+		return err
+	}
 
-func (h *History) WriteToClipboard(entry HistoryEntry) error {
-	mimeType := "text/plain"
-	cpContent := ""
-	if entry.str != nil {
-		cpContent = *entry.str
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
 	}
 
-	if entry.img != nil {
-		mimeType = "text/uri-list"
-		cpContent = *entry.str
+	if h.fsync != FsyncNever {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
 	}
 
-	cmd := exec.Command("wl-copy", "--type", mimeType, "--foreground")
-	stdin, err := cmd.StdinPipe()
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	if err != nil {
+	h.rotateBackups()
+
+	if err := os.Rename(tmp, h.path); err != nil {
 		return err
 	}
+	h.snapshot, _ = os.Stat(h.path)
 
-	if err := cmd.Start(); err != nil {
+	// the journal is only emptied once the snapshot is complete
+	if err := os.Truncate(journalPath(h.path), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
+	h.journalRecords = 0
+	h.journalSize = 0
 
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, cpContent)
-	}()
+	return nil
+}
 
-	go func() {
-		cmd.Wait()
-	}()
+// rotateBackups keeps the current history file as first backup and
+// shifts the older backups, dropping the oldest one.
+func (h *History) rotateBackups() {
+	for i := historyBackups; i > 1; i-- {
+		os.Rename(backupPath(h.path, i-1), backupPath(h.path, i))
+	}
 
-	return nil
+	// a hard link keeps the current file in place until it's replaced
+	backup := backupPath(h.path, 1)
+	os.Remove(backup)
+	if err := os.Link(h.path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		println("Could not back up history:", err.Error())
+	}
 }
 
-func (h *History) removeEntry(index int) (int, error) {
+// backupPath returns the path of the n-th backup of the history file
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Subscribe registers fn to be called for every change of the history.
+// fn is called while the history is locked, so it must not access the
+// history itself but defer the work, e.g. with glib.IdleAdd.
+func (h *History) Subscribe(fn func(change HistoryChange)) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	// get a copy of the reversed entries
-	rEntries := Reverse(h.entries)
-	if index >= len(rEntries) {
-		return -1, errors.New("No entry found")
+	h.subscribers = append(h.subscribers, fn)
+}
+
+// notify passes the change to all subscribers. The caller must hold
+// the lock.
+func (h *History) notify(kind ChangeKind, entry HistoryEntry) {
+	for _, fn := range h.subscribers {
+		fn(HistoryChange{Kind: kind, Entry: entry})
 	}
+}
+
+func (h *History) WriteToClipboard(entry HistoryEntry) error {
+	mimeType := "text/plain"
+	cpContent := ""
+	if entry.str != nil {
+		cpContent = *entry.str
+	}
+
+	if entry.img != nil {
+		mimeType = "text/uri-list"
+		cpContent = *entry.str
+	}
+
+	return h.clipboard.Write([]byte(cpContent), mimeType)
+}
+
+// removeEntry removes the entry with the given id from the history
+func (h *History) removeEntry(id uint64) error {
+	h.lock()
+	defer h.unlock()
+
+	index := h.indexOf(id)
+	if index < 0 {
+		return errors.New("No entry found")
+	}
+
+	return h.deleteAt(index)
+}
 
+// deleteAt removes the entry at the given index of the entries slice
+// and saves the history. The caller must hold the lock.
+func (h *History) deleteAt(index int) error {
 	// check if we're deleting the last entry (which would be the first
 	// entry in the history view in the gui)
-	isLastEntry := index == 0
+	isLastEntry := index == len(h.entries)-1
+	removed := h.entries[index]
 
-	rEntries = slices.Delete(rEntries, index, index+1)
+	h.entries = slices.Delete(h.entries, index, index+1)
+	h.forget(removed)
+	h.reposition(index)
 
 	// empty clipboard if there are no entries
-	if len(rEntries) == 0 {
+	if len(h.entries) == 0 {
 		h.WriteToClipboard(HistoryEntry{})
 	}
 
 	// is last entry, we set the clipboard to the new last entry
 	// so that the goroutine doesn't override our deletion
-	if isLastEntry && len(rEntries) > 0 {
-		h.WriteToClipboard(rEntries[0])
+	if isLastEntry && len(h.entries) > 0 {
+		h.WriteToClipboard(h.entries[len(h.entries)-1])
 	}
 
-	// reverse the the copy of the entries again and save to the
-	// original entries slice so that we can save the history
-	// in the correct order
-	h.entries = Reverse(rEntries)
+	return h.commit(EntryRemoved, removed)
+}
 
-	if err := h.Save(); err != nil {
-		println("Could not save to clipboard history:", err)
-		return -1, err
+// get returns the entry with the given id
+func (h *History) get(id uint64) (HistoryEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if index := h.indexOf(id); index > -1 {
+		return h.entries[index], true
 	}
-	return index, nil
+
+	return HistoryEntry{}, false
 }
 
-func (h *History) clear() error {
-	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// last returns the most recent entry
+func (h *History) last() (HistoryEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.entries) == 0 {
+		return HistoryEntry{}, false
 	}
-	defer f.Close()
 
-	_, err = f.WriteString("")
+	return h.entries[len(h.entries)-1], true
+}
+
+// list returns a copy of the entries, the most recent entry first
+func (h *History) list() []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return Reverse(h.entries)
+}
 
+// search returns all entries matching the query, see ParseQuery.
+// Masked secrets are matched by their mask. The most recent entry comes
+// first.
+func (h *History) search(query string) ([]HistoryEntry, error) {
+	ignoreCase := resolveIgnoreCase(h.conf.StringVal(IgnoreCase, *flagIgnoreCase), query)
+
+	filter, err := ParseQuery(query, ignoreCase)
 	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(h.list(), func(entry HistoryEntry) bool {
+		_, ok := filter.Match(maskedEntry(entry), SearchSubstring, ignoreCase)
+		return !ok
+	}), nil
+}
+
+// copyEntry writes the entry with the given id to the clipboard and
+// moves it to the top of the history.
+func (h *History) copyEntry(id uint64) error {
+	h.lock()
+	defer h.unlock()
+
+	index := h.indexOf(id)
+	if index < 0 {
+		return errors.New("No entry found")
+	}
+
+	entry := h.entries[index]
+	entry.useCount++
+	entry.lastUsed = time.Now()
+
+	h.entries = slices.Delete(h.entries, index, index+1)
+	h.entries = append(h.entries, entry)
+	h.reposition(index)
+
+	if err := h.commit(EntryMoved, entry); err != nil {
 		return err
 	}
 
+	return h.WriteToClipboard(entry)
+}
+
+// indexOf returns the index of the entry with the given id or -1.
+// The caller must hold the lock.
+func (h *History) indexOf(id uint64) int {
+	index, ok := h.positions[id]
+	if !ok {
+		return -1
+	}
+
+	return index
+}
+
+// clear removes all entries from the history except the pinned ones
+func (h *History) clear() error {
+	h.lock()
+	defer h.unlock()
+
+	removed := []HistoryEntry{}
+	h.entries = slices.DeleteFunc(h.entries, func(entry HistoryEntry) bool {
+		if entry.pinned {
+			return false
+		}
+		removed = append(removed, entry)
+		h.forget(entry)
+		return true
+	})
+	h.reposition(0)
+
+	return h.commitRemoved(removed)
+}
+
+// trim drops the oldest entries that exceed the maximum amount of
+// entries. Pinned entries are neither dropped nor counted.
+func (h *History) trim() error {
+	h.lock()
+	defer h.unlock()
+
+	unpinned := 0
+	for _, entry := range h.entries {
+		if !entry.pinned {
+			unpinned++
+		}
+	}
+
+	exceeds := unpinned - h.maxEntries
+	if exceeds <= 0 {
+		return nil
+	}
+
+	removed := []HistoryEntry{}
+	h.entries = slices.DeleteFunc(h.entries, func(entry HistoryEntry) bool {
+		if entry.pinned || exceeds == 0 {
+			return false
+		}
+		exceeds--
+		removed = append(removed, entry)
+		h.forget(entry)
+		return true
+	})
+	h.reposition(0)
+
+	return h.commitRemoved(removed)
+}
+
+// setPinned pins or unpins the entry with the given id
+func (h *History) setPinned(id uint64, pinned bool) error {
+	h.lock()
+	defer h.unlock()
+
+	index := h.indexOf(id)
+	if index < 0 {
+		return errors.New("No entry found")
+	}
+
+	if h.entries[index].ephemeral {
+		return errors.New("Ephemeral entries can't be pinned")
+	}
+
+	h.entries[index].pinned = pinned
+
+	return h.commit(EntryUpdated, h.entries[index])
+}
+
+// commitRemoved commits the removal of several entries. The caller must
+// hold the lock.
+func (h *History) commitRemoved(removed []HistoryEntry) error {
+	for _, entry := range removed {
+		if err := h.commit(EntryRemoved, entry); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (h *History) contains(content string) (bool, int) {
+// nextID returns a new unique entry id. The caller must hold the lock.
+func (h *History) nextID() uint64 {
+	h.lastID++
+	return h.lastID
+}
+
+// indexOfHash returns the index of the entry with the given content
+// hash or -1. The caller must hold the lock.
+func (h *History) indexOfHash(hash string) int {
+	id, ok := h.hashes[hash]
+	if !ok {
+		return -1
+	}
+
+	return h.indexOf(id)
+}
+
+// reindex rebuilds the hash and position indexes and raises the last id
+// to the highest id of the entries. The caller must hold the lock.
+func (h *History) reindex() {
+	clear(h.hashes)
+	clear(h.positions)
 	for i, entry := range h.entries {
-		if *entry.str == content {
-			return true, i
-		}
+		h.lastID = max(h.lastID, entry.id)
+		h.hashes[entry.hash] = entry.id
+		h.positions[entry.id] = i
 	}
+}
 
-	return false, -1
+// reposition updates the positions of the entries from the given index
+// on, after entries were removed or moved there. The caller must hold
+// the lock.
+func (h *History) reposition(from int) {
+	for i := from; i < len(h.entries); i++ {
+		h.positions[h.entries[i].id] = i
+	}
+}
+
+// forget removes the entry from the indexes. The caller must hold the
+// lock.
+func (h *History) forget(entry HistoryEntry) {
+	delete(h.positions, entry.id)
+
+	// an old history might contain the same content twice
+	if h.hashes[entry.hash] == entry.id {
+		delete(h.hashes, entry.hash)
+	}
 }
 
+// cleanCache removes the cached images that no entry refers to anymore.
+// An image is referred to if an entry has the hash of its content.
 func (h *History) cleanCache() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// the entries of a locked history are unknown
+	if h.locked {
+		return nil
+	}
+
 	cacheDir, _ := CacheDir()
 
 	if dir, err := os.ReadDir(cacheDir); err == nil {
 		for _, d := range dir {
 			path := cacheDir + "/" + d.Name()
 			f := fileUrl(path, nil)
+			hash := contentHash(HistoryEntry{str: &f, img: &Image{path: path}})
 
-			if ok, _ := h.contains(f); !ok {
+			if _, ok := h.hashes[hash]; !ok {
 				if err := os.Remove(path); err != nil {
 					return err
 				}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+)
+
+// Values of the fsync option
+const (
+	// FsyncAlways syncs the journal after every change
+	FsyncAlways = "always"
+	// FsyncSnapshot only syncs the snapshot written on compaction
+	FsyncSnapshot = "snapshot"
+	// FsyncNever leaves syncing to the operating system
+	FsyncNever = "never"
+)
+
+// journalLimit is the number of journal records after which the journal
+// is compacted into the history file
+const journalLimit = 500
+
+// The history is stored as snapshot, the history file, and a journal
+// next to it. Every change is appended to the journal as a single line
+// of JSON, the same storedChange that is sent to the user interface.
+// On startup the journal is replayed on top of the snapshot, records
+// appended by other processes are merged while running. Once the journal
+// has grown past journalLimit records it's compacted, i.e. a new
+// snapshot is written and the journal is emptied. Replaying a record
+// twice leads to the same result, so a crash between writing the
+// snapshot and emptying the journal doesn't corrupt the history.
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// decodeJournal decodes the journal records, decrypting them with key if
+// they're encrypted, and returns them along with the length of the valid
+// part of the journal. A record that can't be decoded, e.g. because
+// bbclip crashed while writing it, ends the journal. Unencrypted records
+// of an encrypted journal are skipped.
+func decodeJournal(data []byte, key *historyKey) ([]HistoryChange, int) {
+	changes := []HistoryChange{}
+	valid := 0
+
+	for len(data) > valid {
+		line, _, ok := bytes.Cut(data[valid:], []byte("\n"))
+		if !ok {
+			println("Ignoring incomplete journal record")
+			break
+		}
+
+		plain, err := key.decryptRecord(line)
+		if errors.Is(err, errUnencryptedRecord) {
+			println("Ignoring unencrypted journal record")
+			valid += len(line) + 1
+			continue
+		}
+		if err != nil {
+			println("Ignoring undecryptable journal record:", err.Error())
+			break
+		}
+
+		var record storedChange
+		if err := json.Unmarshal(plain, &record); err != nil {
+			println("Ignoring invalid journal record:", err.Error())
+			break
+		}
+
+		changes = append(changes, record.change())
+		valid += len(line) + 1
+	}
+
+	return changes, valid
+}
+
+// applyRecord applies a single change to the entries, which are in
+// chronological order.
+func applyRecord(entries []HistoryEntry, change HistoryChange) []HistoryEntry {
+	index := slices.IndexFunc(entries, func(entry HistoryEntry) bool {
+		return entry.id == change.Entry.id
+	})
+
+	switch change.Kind {
+	case EntryAdded, EntryMoved:
+		if index >= 0 {
+			entries = slices.Delete(entries, index, index+1)
+		}
+		entries = append(entries, change.Entry)
+
+	case EntryUpdated:
+		if index >= 0 {
+			entries[index] = change.Entry
+		}
+
+	case EntryRemoved:
+		if index >= 0 {
+			entries = slices.Delete(entries, index, index+1)
+		}
+	}
+
+	return entries
+}
+
+// commit appends the change to the journal and notifies the subscribers
+// once it's written. The journal is compacted in the background once it's
+// too long. The caller must hold the lock.
+func (h *History) commit(kind ChangeKind, entry HistoryEntry) error {
+	if h.locked {
+		return ErrHistoryLocked
+	}
+
+	// ephemeral entries only live in memory
+	if entry.ephemeral {
+		h.notify(kind, entry)
+		return nil
+	}
+
+	if h.journal == nil {
+		f, err := os.OpenFile(
+			journalPath(h.path),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+			0644,
+		)
+		if err != nil {
+			return err
+		}
+		h.journal = f
+	}
+
+	data, err := json.Marshal(HistoryChange{Kind: kind, Entry: entry}.stored())
+	if err != nil {
+		return err
+	}
+
+	if h.key != nil {
+		if data, err = h.key.encryptRecord(data); err != nil {
+			return err
+		}
+	}
+
+	n, err := h.journal.Write(append(data, '\n'))
+	h.journalSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if h.fsync == FsyncAlways {
+		if err := h.journal.Sync(); err != nil {
+			return err
+		}
+	}
+
+	h.notify(kind, entry)
+
+	h.journalRecords++
+	if h.journalRecords >= journalLimit && !h.compacting {
+		h.compacting = true
+		go h.compact()
+	}
+
+	return nil
+}
+
+// compact writes the current entries as new snapshot and empties the
+// journal.
+func (h *History) compact() {
+	h.lock()
+	defer h.unlock()
+
+	if err := h.Save(); err != nil {
+		println("Could not compact history journal:", err.Error())
+	}
+
+	h.compacting = false
+}
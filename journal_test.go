@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// journalRecord returns the encoded journal record of the change
+func journalRecord(t *testing.T, kind ChangeKind, entry HistoryEntry) string {
+	t.Helper()
+
+	data, err := json.Marshal(HistoryChange{Kind: kind, Entry: entry}.stored())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data) + "\n"
+}
+
+func TestDecodeJournal(t *testing.T) {
+	added := journalRecord(t, EntryAdded, textEntry(1, "one"))
+	removed := journalRecord(t, EntryRemoved, textEntry(1, "one"))
+
+	tests := []struct {
+		name    string
+		journal string
+		changes int
+		valid   int
+	}{
+		{name: "empty", journal: "", changes: 0, valid: 0},
+		{name: "complete", journal: added + removed, changes: 2, valid: len(added + removed)},
+		{name: "torn record", journal: added + removed[:10], changes: 1, valid: len(added)},
+		{name: "missing newline", journal: added + strings.TrimSuffix(removed, "\n"), changes: 1, valid: len(added)},
+		{name: "invalid record", journal: added + "{\"kind\":\n" + removed, changes: 1, valid: len(added)},
+		{name: "garbage", journal: "\x00\x00\x00\n" + added, changes: 0, valid: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, valid := decodeJournal([]byte(tt.journal), nil)
+			if len(changes) != tt.changes {
+				t.Errorf("changes = %d, want %d", len(changes), tt.changes)
+			}
+			if valid != tt.valid {
+				t.Errorf("valid = %d, want %d", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestApplyRecord(t *testing.T) {
+	one, two, three := textEntry(1, "one"), textEntry(2, "two"), textEntry(3, "three")
+	pinned := two
+	pinned.pinned = true
+
+	tests := []struct {
+		name    string
+		entries []HistoryEntry
+		changes []HistoryChange
+		want    []string
+	}{
+		{
+			name:    "added",
+			entries: []HistoryEntry{one},
+			changes: []HistoryChange{{Kind: EntryAdded, Entry: two}},
+			want:    []string{"one", "two"},
+		},
+		{
+			name:    "moved",
+			entries: []HistoryEntry{one, two, three},
+			changes: []HistoryChange{{Kind: EntryMoved, Entry: one}},
+			want:    []string{"two", "three", "one"},
+		},
+		{
+			name:    "removed",
+			entries: []HistoryEntry{one, two, three},
+			changes: []HistoryChange{{Kind: EntryRemoved, Entry: two}},
+			want:    []string{"one", "three"},
+		},
+		{
+			name:    "replayed twice",
+			entries: []HistoryEntry{one},
+			changes: []HistoryChange{
+				{Kind: EntryAdded, Entry: two},
+				{Kind: EntryAdded, Entry: two},
+				{Kind: EntryRemoved, Entry: one},
+				{Kind: EntryRemoved, Entry: one},
+			},
+			want: []string{"two"},
+		},
+		{
+			name:    "unknown entry",
+			entries: []HistoryEntry{one},
+			changes: []HistoryChange{{Kind: EntryUpdated, Entry: two}, {Kind: EntryRemoved, Entry: three}},
+			want:    []string{"one"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := slices.Clone(tt.entries)
+			for _, change := range tt.changes {
+				entries = applyRecord(entries, change)
+			}
+
+			if got := texts(entries); !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	entries := applyRecord([]HistoryEntry{one, two}, HistoryChange{Kind: EntryUpdated, Entry: pinned})
+	if !entries[1].pinned {
+		t.Error("updated entry wasn't replaced")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	h := newTestHistory(t)
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := h.add(NewHistoryEntry(text, nil, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.setPinned(h.entries[0].id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.removeEntry(h.entries[1].id); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.copyEntry(h.entries[0].id); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"three", "one"}
+	if got := texts(h.entries); !slices.Equal(got, want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+
+	// a record torn by a crash is dropped
+	f, err := os.OpenFile(journalPath(h.path), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"kind":"added","entry":{"id":9`)
+	f.Close()
+
+	replayed := reopen(h)
+	if got := texts(replayed.entries); !slices.Equal(got, want) {
+		t.Errorf("replayed entries = %v, want %v", got, want)
+	}
+	if !replayed.entries[1].pinned || replayed.entries[1].useCount != 1 {
+		t.Errorf("metadata wasn't replayed: %+v", replayed.entries[1].stored())
+	}
+
+	info, err := os.Stat(journalPath(h.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != replayed.journalSize {
+		t.Errorf("journal size = %d, want it truncated to %d", info.Size(), replayed.journalSize)
+	}
+
+	// new records are appended after the valid part
+	if err := replayed.add(NewHistoryEntry("four", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "four")
+	if got := texts(reopen(h).entries); !slices.Equal(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestCommitNotifiesAfterWriting(t *testing.T) {
+	h := newTestHistory(t)
+
+	var journaled []bool
+	h.Subscribe(func(change HistoryChange) {
+		data, _ := os.ReadFile(journalPath(h.path))
+		journaled = append(journaled, strings.Contains(string(data), *change.Entry.str))
+	})
+
+	if err := h.add(NewHistoryEntry("one", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(journaled, []bool{true}) {
+		t.Errorf("journaled when notified = %v, want [true]", journaled)
+	}
+}
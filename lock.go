@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Several processes can use the same history files, e.g. the daemon and
+// `bbclip list` or a second bbclip instance. The files are only read or
+// written while holding an advisory lock on a separate lock file, the
+// history file itself can't be locked since Save replaces it.
+//
+// Whenever the lock is taken the changes other processes made in the
+// meantime are merged into the entries first: records appended to the
+// journal are applied like our own, a replaced history file, e.g. after
+// another process compacted the journal, is read again. Long running
+// processes also watch the files so the changes show up right away.
+
+// lock locks the history in memory and on disk and merges the external
+// changes.
+func (h *History) lock() {
+	h.mu.Lock()
+	h.flock()
+	h.merge()
+}
+
+// unlock releases both locks taken by lock
+func (h *History) unlock() {
+	if h.lockFile != nil {
+		syscall.Flock(int(h.lockFile.Fd()), syscall.LOCK_UN)
+	}
+	h.mu.Unlock()
+}
+
+// flock takes the lock on the lock file, waiting for other processes
+// to release it. The caller must hold the lock.
+func (h *History) flock() {
+	if h.lockFile == nil {
+		f, err := os.OpenFile(h.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			println("Could not open history lock:", err.Error())
+			return
+		}
+		h.lockFile = f
+	}
+
+	if err := syscall.Flock(int(h.lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		println("Could not lock history:", err.Error())
+	}
+}
+
+// merge applies the changes other processes made to the history files.
+// The caller must hold both locks.
+func (h *History) merge() {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return
+	}
+
+	if h.snapshot == nil || !os.SameFile(info, h.snapshot) ||
+		info.Size() != h.snapshot.Size() || !info.ModTime().Equal(h.snapshot.ModTime()) {
+		h.reload()
+		return
+	}
+
+	// the journal of a locked history can't be read
+	if h.locked {
+		return
+	}
+
+	size := int64(0)
+	if journal, err := os.Stat(journalPath(h.path)); err == nil {
+		size = journal.Size()
+	}
+
+	// the journal was emptied without replacing the history file
+	if size < h.journalSize {
+		h.reload()
+		return
+	}
+
+	if size == h.journalSize {
+		return
+	}
+
+	data, err := os.ReadFile(journalPath(h.path))
+	if err != nil || int64(len(data)) < h.journalSize {
+		return
+	}
+
+	changes, valid := decodeJournal(data[h.journalSize:], h.key)
+	h.journalSize += int64(valid)
+	h.journalRecords += len(changes)
+
+	for _, change := range changes {
+		h.entries = applyRecord(h.entries, change)
+
+		if change.Kind == EntryRemoved {
+			h.forget(change.Entry)
+		} else {
+			h.hashes[change.Entry.hash] = change.Entry.id
+		}
+		h.lastID = max(h.lastID, change.Entry.id)
+		h.reposition(0)
+
+		h.notify(change.Kind, change.Entry)
+	}
+}
+
+// reload reads the history files again and notifies the subscribers
+// about the differences to the current entries. The caller must hold
+// both locks.
+func (h *History) reload() {
+	entries, err := h.Read()
+
+	// e.g. encrypted by another process, the entries are dropped
+	// until the history is unlocked
+	h.locked = errors.Is(err, ErrHistoryLocked)
+	if h.locked {
+		h.key = nil
+		entries = []HistoryEntry{}
+	} else if err != nil && !errors.Is(err, ErrHistoryRecovered) {
+		println("Could not reload history:", err.Error())
+		return
+	}
+
+	previous := h.entries
+
+	// ephemeral entries aren't in the files, keep them unless the
+	// history was locked
+	for _, entry := range previous {
+		if entry.ephemeral && !h.locked {
+			entries = append(entries, entry)
+		}
+	}
+
+	h.entries = entries
+	h.reindex()
+
+	if errors.Is(err, ErrHistoryRecovered) {
+		println(err.Error())
+		if err := h.Save(); err != nil {
+			println("Could not save recovered history:", err.Error())
+		}
+	}
+
+	current := make(map[uint64]HistoryEntry, len(entries))
+	for _, entry := range entries {
+		current[entry.id] = entry
+	}
+
+	known := make(map[uint64]HistoryEntry, len(previous))
+	for _, entry := range previous {
+		known[entry.id] = entry
+		if _, ok := current[entry.id]; !ok {
+			h.notify(EntryRemoved, entry)
+		}
+	}
+
+	// in chronological order, so moved entries end up in the same order
+	for _, entry := range entries {
+		prev, ok := known[entry.id]
+
+		switch {
+		case !ok:
+			h.notify(EntryAdded, entry)
+		case !prev.lastUsed.Equal(entry.lastUsed):
+			h.notify(EntryMoved, entry)
+		case prev.pinned != entry.pinned:
+			h.notify(EntryUpdated, entry)
+		}
+	}
+}
+
+// watchFile merges the changes of other processes as soon as the history
+// files are modified. It watches the data directory since the history
+// file is replaced on every Save.
+func (h *History) watchFile() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		println("Could not watch history file:", err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(h.path), mask); err != nil {
+		println("Could not watch history file:", err.Error())
+		return
+	}
+
+	names := map[string]bool{
+		filepath.Base(h.path):              true,
+		filepath.Base(journalPath(h.path)): true,
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			println("Could not watch history file:", err.Error())
+			return
+		}
+
+		// all events read at once are handled by a single merge
+		if watchedEvent(buf[:n], names) {
+			h.lock()
+			h.unlock()
+		}
+	}
+}
+
+// watchedEvent returns whether one of the inotify events in buf refers
+// to one of the given file names.
+func watchedEvent(buf []byte, names map[string]bool) bool {
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		end := min(start+int(event.Len), len(buf))
+
+		if names[string(bytes.TrimRight(buf[start:end], "\x00"))] {
+			return true
+		}
+
+		offset = end
+	}
+
+	return false
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/url"
 	"os"
 	"slices"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/dlasky/gotk3-layershell/layershell"
@@ -21,7 +21,6 @@ import (
 )
 
 const (
-	socketPath      = "/tmp/bbclip.sock"
 	userCssFileName = "style.css"
 	initialItems    = 20
 	defaultWidth    = 350
@@ -36,19 +35,37 @@ var (
 	dev     string
 	commit  string
 
-	flagShowVersion       = flag.Bool("version", false, "Shows the version")
-	flagClearHistory      = flag.Bool("clear-history", false, "Clears the history")
-	flagSystemTheme       = flag.Bool("system-theme", false, "Uses the system gtk theme")
-	flagMaxEntries        = flag.Int("max-entries", 100, "Maximum amount of clipboard entries the history should hold")
-	flagLayerShell        = flag.Bool("layer-shell", true, "Use layer shell instead of window")
-	flagSilent            = flag.Bool("silent", false, "Starts bbclip silently in the background")
-	flagIcons             = flag.Bool("icons", false, "")
-	flagTextPreviewLength = flag.Int("text-preview-length", 100, "The length of the preview text before it's truncated")
-	flagImageSupport      = flag.Bool("image-support", false, "Whether to enable image support")
-	flagImageHeight       = flag.Int("image-height", 50, "Image height")
-	flagImagePreview      = flag.Bool("image-preview", true, "Whether to show a tiny preview of the image")
-	flagPreviewWidth      = flag.Int("preview-width", 300, "The width of the preview window")
-	flagShowPreview       = flag.Bool("show-preview", false, "Whether to show the preview window by default when opening bbclip.")
+	flagShowVersion         = flag.Bool("version", false, "Shows the version")
+	flagClearHistory        = flag.Bool("clear-history", false, "Clears the history")
+	flagSystemTheme         = flag.Bool("system-theme", false, "Uses the system gtk theme")
+	flagMaxEntries          = flag.Int("max-entries", 100, "Maximum amount of clipboard entries the history should hold")
+	flagLayerShell          = flag.Bool("layer-shell", true, "Use layer shell instead of window")
+	flagSilent              = flag.Bool("silent", false, "Starts bbclip silently in the background")
+	flagIcons               = flag.Bool("icons", false, "")
+	flagTextPreviewLength   = flag.Int("text-preview-length", 100, "The length of the preview text before it's truncated")
+	flagImageSupport        = flag.Bool("image-support", false, "Whether to enable image support")
+	flagImageHeight         = flag.Int("image-height", 50, "Image height")
+	flagImagePreview        = flag.Bool("image-preview", true, "Whether to show a tiny preview of the image")
+	flagPreviewWidth        = flag.Int("preview-width", 300, "The width of the preview window")
+	flagShowPreview         = flag.Bool("show-preview", false, "Whether to show the preview window by default when opening bbclip.")
+	flagPoll                = flag.Bool("poll", false, "Polls the clipboard instead of watching it for changes")
+	flagBackend             = flag.String("backend", "auto", "The clipboard backend to use (auto, wayland, x11)")
+	flagPin                 = flag.Uint64("pin", 0, "Pins the history entry with the given id")
+	flagUnpin               = flag.Uint64("unpin", 0, "Unpins the history entry with the given id")
+	flagSearchMode          = flag.String("search-mode", SearchFuzzy, "How entries are searched (fuzzy, substring, exact-word)")
+	flagCloseOnBlur         = flag.Bool("close-on-blur", true, "Hides the window when it loses focus")
+	flagFsync               = flag.String("fsync", FsyncSnapshot, "When history writes are synced to disk (always, snapshot, never)")
+	flagIgnoreCase          = flag.String("ignore-case", IgnoreCaseTrue, "Whether the search ignores the case (true, false, smart)")
+	flagKeyFile             = flag.String("key-file", "", "The file containing the passphrase of the encrypted history")
+	flagKeyCommand          = flag.String("key-command", "", "The command printing the passphrase of the encrypted history")
+	flagPasswordManagerHint = flag.String("password-manager-hint", HintSkip, "What to do with secrets copied from password managers (skip, ephemeral, ignore)")
+	flagEphemeralTimeout    = flag.Int("ephemeral-timeout", 30, "Seconds after which ephemeral entries are removed")
+	flagSecretAction        = flag.String("secret-action", SecretMask, "What to do with detected secrets (drop, mask, expire, ignore)")
+	flagSecretDetectors     = flag.String("secret-detectors", "all", "Comma separated list of the enabled secret detectors, all or none")
+	flagIncludeApps         = flag.String("include-apps", "", "Comma separated app ids, only content copied from these apps is recorded")
+	flagExcludeApps         = flag.String("exclude-apps", "", "Comma separated app ids content copied from isn't recorded")
+	flagExcludeUrls         = flag.String("exclude-urls", "", "Comma separated host names of pages content copied from isn't recorded")
+	flagSocket              = flag.String("socket", defaultSocketPath(), "The path of the socket used to control bbclip")
 )
 
 type EntriesList struct {
@@ -56,14 +73,62 @@ type EntriesList struct {
 	// history entries
 	scrolledWin *gtk.ScrolledWindow
 	// entriesList is the history entries list view
-	box   *gtk.ListBox
-	items map[int]HistoryEntry
+	box *gtk.ListBox
+
+	// entries are all history entries, the most recent first
+	entries []HistoryEntry
+	// results are the entries matching the search query in the order
+	// they are displayed. Only the first limit results are added to the
+	// list box, more are added while scrolling down.
+	results []listResult
+	limit   int
+	// filter is the parsed search query
+	filter     *Filter
+	ignoreCase bool
+
+	// rows caches the row widgets by entry id, including the ones
+	// that are currently not in the list box
+	rows map[uint64]*entryRow
+	// thumbs caches the scaled image previews by entry id
+	thumbs map[uint64]*gdk.Pixbuf
+	// revealed are the ids of the masked entries that are shown anyway
+	revealed map[uint64]bool
 }
 
+// listResult is an entry matching the search query
+type listResult struct {
+	entry HistoryEntry
+	match Match
+}
+
+// entryRow is a single row of the entries list
+type entryRow struct {
+	entry   HistoryEntry
+	row     *gtk.ListBoxRow
+	label   *gtk.Label
+	preview string
+	// attached is true while the row is in the list box
+	attached bool
+	// headerKind is the kind of header currently shown above the row
+	headerKind string
+}
+
+// Kinds of row headers
+const (
+	headerNone      = ""
+	headerPinned    = "pinned"
+	headerSeparator = "separator"
+)
+
 type BBClip struct {
-	// history is the clipboard history
+	// history is the clipboard history. It's nil if the history is
+	// collected by a separate daemon.
 	history *History
-	conf    *Config
+	// client is used to access the history, either the local one or
+	// the one of the daemon
+	client     HistoryClient
+	conf       *Config
+	maxEntries int
 
 	// window is the gtk window
 	window *gtk.Window
@@ -80,9 +145,26 @@ type BBClip struct {
 	// search is the search input field
 	search *gtk.Entry
 
+	// pausedLabel is shown above the search field while capturing the
+	// clipboard is paused
+	pausedLabel *gtk.Label
+	// resumeTimeout updates pausedLabel once the capture resumes
+	resumeTimeout glib.SourceHandle
+
 	// cssProvider is the gtk css provider
 	cssProvider *gtk.CssProvider
 
+	// server is the socket server handling commands of other processes
+	server *SocketServer
+
+	// sticky keeps the window open after an entry was copied and when
+	// it loses focus
+	sticky bool
+
+	// locked is true while the history is encrypted and locked, the
+	// search entry asks for the passphrase instead
+	locked bool
+
 	visTime time.Time
 }
 
@@ -94,7 +176,28 @@ func main() {
 		return
 	}
 
-	if tryConnectSocket() {
+	if flag.Arg(0) == "daemon" {
+		os.Exit(runDaemon())
+	}
+
+	if flag.NArg() > 0 && isCommand(flag.Arg(0)) {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	if *flagPin > 0 || *flagUnpin > 0 {
+		pinEntry()
+		return
+	}
+
+	conf := NewConfig()
+	path := SocketPath(conf)
+
+	shown, daemon, err := tryConnectSocket(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if shown {
 		fmt.Println("Another instance already running. Exiting.")
 		return
 	}
@@ -102,12 +205,31 @@ func main() {
 	gtk.Init(nil)
 
 	bbclip := BBClip{
-		history: &History{},
-		conf:    NewConfig(),
+		conf:       conf,
+		maxEntries: conf.IntVal(MaxEntries, *flagMaxEntries),
+	}
+
+	if daemon {
+		// the daemon collects the history, we only display it
+		bbclip.client = &SocketClient{path: path}
+		path = uiSocketPath(path)
+	} else {
+		bbclip.history, err = OpenHistory(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bbclip.history.Init()
+		bbclip.history.Subscribe(func(change HistoryChange) {
+			glib.IdleAdd(func() {
+				bbclip.applyChange(change)
+			})
+		})
+		bbclip.client = &LocalClient{history: bbclip.history}
 	}
 
 	bbclip.buildUi()
-	bbclip.listenSocket()
+	bbclip.listenSocket(path)
+	bbclip.updatePaused()
 
 	if !bbclip.conf.BoolVal(Silent, *flagSilent) {
 		bbclip.window.ShowAll()
@@ -123,10 +245,6 @@ func main() {
 		glib.IdleAdd(func() {
 			if bbclip.window.IsVisible() {
 				bbclip.goToTop()
-				bbclip.refreshEntryList(
-					initialItems+1,
-					bbclip.history.maxEntries,
-				)
 			}
 		})
 	}
@@ -135,11 +253,8 @@ func main() {
 }
 
 // buildUi builds the main ui, applies css style and populates the
-// clipboard history.
+// clipboard history list.
 func (b *BBClip) buildUi() {
-	b.history = NewHistory(b.conf)
-	b.history.Init()
-
 	var err error
 
 	b.window, err = gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
@@ -153,10 +268,15 @@ func (b *BBClip) buildUi() {
 
 	b.buildSearchBar()
 	b.buildEntriesList()
-	b.refreshEntryList(0, initialItems)
+	b.refreshEntryList()
 	b.buildWindow()
 
+	b.pausedLabel, _ = gtk.LabelNew("")
+	b.pausedLabel.SetNoShowAll(true)
+	b.addContextClass(b.pausedLabel.ToWidget(), "paused-indicator")
+
 	b.popupWrapper, _ = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 8)
+	b.popupWrapper.PackStart(b.pausedLabel, false, false, 0)
 	b.popupWrapper.PackStart(b.search, true, true, 0)
 	b.popupWrapper.PackStart(b.entriesList.scrolledWin, true, true, 0)
 
@@ -208,72 +328,94 @@ func (b *BBClip) buildEntriesList() {
 	b.entriesList.box.SetSelectionMode(gtk.SELECTION_SINGLE)
 	b.entriesList.box.SetMarginBottom(6)
 	b.entriesList.box.Connect("row-activated", b.onRowActivated)
-	b.entriesList.items = make(map[int]HistoryEntry)
+	b.entriesList.box.SetHeaderFunc(b.updateHeader)
+	b.entriesList.rows = make(map[uint64]*entryRow)
+	b.entriesList.thumbs = make(map[uint64]*gdk.Pixbuf)
+	b.entriesList.revealed = make(map[uint64]bool)
+	b.entriesList.filter = &Filter{}
 
 	b.entriesList.scrolledWin, _ = gtk.ScrolledWindowNew(nil, nil)
 	b.entriesList.scrolledWin.SetSizeRequest(defaultWidth, defaultHeight)
 	b.entriesList.scrolledWin.SetOverlayScrolling(true)
 	b.entriesList.scrolledWin.Add(b.entriesList.box)
+
+	// add more rows before the end of the list is reached
+	vadj := b.entriesList.scrolledWin.GetVAdjustment()
+	vadj.Connect("value-changed", b.onScroll)
+	vadj.Connect("changed", b.onScroll)
 }
 
-// listenSocket sets up a Unix domain socket server to listen for incoming commands.
-// It removes any existing socket file at the defined path, then listens asynchronously.
-// When a "SHOW" command is received, it triggers the GUI to refresh and
-// bring the window to the foreground.
-func (b *BBClip) listenSocket() {
-	// Remove any existing socket file to avoid "address already in use" error.
-	os.Remove(socketPath)
+// listenSocket starts the socket server and registers the commands
+// that control the window: SHOW, HIDE and TOGGLE. If the history is
+// collected by the daemon, only these commands are served.
+func (b *BBClip) listenSocket(path string) {
+	b.server = NewSocketServer(path, b.history)
 
-	ln, err := net.Listen("unix", socketPath)
-	if err != nil {
-		panic(err)
-	}
+	b.server.Handle("SHOW", func(_ string) Response {
+		glib.IdleAddPriority(glib.PRIORITY_HIGH_IDLE, b.show)
+		return okResponse(nil)
+	})
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				fmt.Println("accept err:", err)
-				continue
-			}
+	b.server.Handle("HIDE", func(_ string) Response {
+		glib.IdleAddPriority(glib.PRIORITY_HIGH_IDLE, b.window.Hide)
+		return okResponse(nil)
+	})
 
-			buf := make([]byte, 16)
-			n, _ := conn.Read(buf)
-
-			if string(buf[:n]) == "SHOW\n" {
-				glib.IdleAddPriority(glib.PRIORITY_HIGH_IDLE, func() {
-					b.refreshEntryList(0, initialItems)
-					b.window.ShowAll()
-					b.window.Present()
-
-					if !b.conf.BoolVal(ShowPreview, *flagShowPreview) {
-						// since the preview window is built before the main
-						// window is shown ShowAll would also display the p
-						// review window by default. So we close it initially
-						b.preview.toggle()
-					}
-
-					b.goToTop()
-					glib.IdleAdd(func() {
-						if b.window.IsVisible() {
-							b.refreshEntryList(
-								initialItems+1,
-								b.history.maxEntries,
-							)
-						}
-					})
-					b.visTime = time.Now()
-				})
+	b.server.Handle("TOGGLE", func(_ string) Response {
+		glib.IdleAddPriority(glib.PRIORITY_HIGH_IDLE, func() {
+			if b.window.IsVisible() {
+				b.window.Hide()
+			} else {
+				b.show()
 			}
-			conn.Close()
+		})
+		return okResponse(nil)
+	})
+
+	// sent by the daemon for every change of the history
+	b.server.Handle("CHANGED", func(args string) Response {
+		var change storedChange
+		if err := json.Unmarshal([]byte(args), &change); err != nil {
+			return errorResponse(CodeInvalidArgument, "Invalid change "+args)
 		}
-	}()
+
+		glib.IdleAdd(func() {
+			b.applyChange(change.change())
+		})
+		return okResponse(nil)
+	})
+
+	if err := b.server.Listen(); err != nil {
+		panic(err)
+	}
+}
+
+// show refreshes the history list and brings the window to the foreground.
+func (b *BBClip) show() {
+	b.refreshEntryList()
+	b.updatePaused()
+	b.window.ShowAll()
+	b.window.Present()
+
+	if !b.conf.BoolVal(ShowPreview, *flagShowPreview) {
+		// since the preview window is built before the main
+		// window is shown ShowAll would also display the p
+		// review window by default. So we close it initially
+		b.preview.toggle()
+	}
+
+	b.goToTop()
+	b.visTime = time.Now()
 }
 
 func (b *BBClip) handleKeyEvents(key *gdk.EventKey) bool {
 	name := gdk.KeyValName(key.KeyVal())
 	sinceShow := time.Since(b.visTime)
 
+	if b.locked {
+		return b.handleLockedKeyEvents(key)
+	}
+
 	switch name {
 	case "Escape":
 		if b.search.HasFocus() {
@@ -290,6 +432,26 @@ func (b *BBClip) handleKeyEvents(key *gdk.EventKey) bool {
 
 	case "Delete", "D":
 		b.deleteSelectedRow()
+	case "P":
+		if !b.search.HasFocus() {
+			b.togglePinSelectedRow()
+		}
+	case "s":
+		if !b.search.HasFocus() {
+			b.toggleSticky()
+		}
+	case "L":
+		if !b.search.HasFocus() {
+			b.lockHistory()
+		}
+	case "r":
+		if !b.search.HasFocus() {
+			b.toggleReveal()
+		}
+	case "I":
+		if !b.search.HasFocus() {
+			b.togglePause()
+		}
 	case "Return":
 		if b.entriesList != nil && sinceShow > 200*time.Millisecond {
 			row := b.entriesList.box.GetSelectedRow()
@@ -341,36 +503,253 @@ func (b *BBClip) handleKeyEvents(key *gdk.EventKey) bool {
 	return false
 }
 
+// handleLockedKeyEvents handles the keys while the passphrase is asked
+// for, every other key is typed into the passphrase entry.
+func (b *BBClip) handleLockedKeyEvents(key *gdk.EventKey) bool {
+	switch gdk.KeyValName(key.KeyVal()) {
+	case "Escape":
+		if time.Since(b.visTime) > 200*time.Millisecond {
+			b.window.Hide()
+		}
+		return true
+
+	case "Return":
+		b.unlockHistory()
+		return true
+	}
+
+	if key.State()&gdk.CONTROL_MASK != 0 && key.KeyVal() == gdk.KEY_c {
+		gtk.MainQuit()
+	}
+
+	return false
+}
+
 // searchAndFocus hides or shows clipboard entries depending
 // on the given search query and automatically selects the first result.
-// If ignoreCase is true the search is case insensitive.
+// Matching rows are sorted by their score and the matched characters
+// are highlighted. If ignoreCase is true the search is case insensitive.
 func (b *BBClip) searchAndFocus(query string, ignoreCase bool) {
-	b.entriesList.box.GetChildren().Foreach(func(item any) {
-		widget := item.(*gtk.Widget)
+	if b.filterRows(query, ignoreCase) {
+		b.goToTop()
+	}
+}
+
+// filterRows applies the search query to the list and returns false if
+// the query is invalid. In that case the list is left as it is.
+func (b *BBClip) filterRows(query string, ignoreCase bool) bool {
+	filter, err := ParseQuery(query, ignoreCase)
+	b.showSearchError(err)
+	if err != nil {
+		// keep the last result until the query is valid again
+		return false
+	}
+
+	b.entriesList.filter = filter
+	b.entriesList.ignoreCase = ignoreCase
+	b.entriesList.limit = initialItems
+	b.renderList()
+
+	return true
+}
 
-		row := gtk.ListBoxRow{
-			Bin: gtk.Bin{
-				Container: gtk.Container{
-					Widget: *widget,
-				},
-			},
+// renderList matches all entries against the search query and updates
+// the list box to show the first limit results. Rows that are already
+// in the right place are left alone, so small changes like deleting an
+// entry only touch the affected rows.
+func (b *BBClip) renderList() {
+	l := b.entriesList
+	mode := b.conf.StringVal(SearchMode, *flagSearchMode)
+
+	l.results = l.results[:0]
+	for _, entry := range l.entries {
+		// revealed secrets are matched by their text
+		target := entry
+		if l.masked(entry) {
+			target = maskedEntry(entry)
 		}
 
-		rowContent := *b.entriesList.items[row.GetIndex()].str
+		if match, ok := l.filter.Match(target, mode, l.ignoreCase); ok {
+			l.results = append(l.results, listResult{entry: entry, match: match})
+		}
+	}
+
+	// the sort is stable, so results with the same score stay in
+	// chronological order
+	slices.SortStableFunc(l.results, func(r1, r2 listResult) int {
+		if r1.match.Score != r2.match.Score {
+			return r2.match.Score - r1.match.Score
+		}
+
+		switch {
+		case r1.entry.pinned && !r2.entry.pinned:
+			return -1
+		case !r1.entry.pinned && r2.entry.pinned:
+			return 1
+		}
+
+		return 0
+	})
+
+	shown := l.results[:min(l.limit, len(l.results))]
+
+	ids := make(map[uint64]bool, len(shown))
+	for _, r := range shown {
+		ids[r.entry.id] = true
+	}
 
-		if ignoreCase {
-			rowContent = strings.ToLower(rowContent)
-			query = strings.ToLower(query)
+	// rows that are no longer shown stay cached
+	for _, item := range l.rows {
+		if item.attached && !ids[item.entry.id] {
+			b.detachRow(item)
+		}
+	}
+
+	index := 0
+	for _, r := range shown {
+		item := b.rowFor(r.entry)
+		if item == nil {
+			continue
+		}
+
+		if item.attached && item.row.GetIndex() != index {
+			b.detachRow(item)
 		}
 
-		if strings.Contains(rowContent, query) {
-			row.Show()
+		if !item.attached {
+			l.box.Insert(item.row, index)
+			item.attached = true
+		}
+
+		item.entry = r.entry
+		if l.masked(r.entry) {
+			// the mask isn't highlighted
+			item.highlight(nil)
 		} else {
-			row.Hide()
+			item.highlight(r.match.Positions)
 		}
+		index++
+	}
+
+	l.box.InvalidateHeaders()
+}
+
+// loadMore adds the next page of results to the list box
+func (b *BBClip) loadMore() {
+	l := b.entriesList
+	if l.limit >= len(l.results) {
+		return
+	}
+
+	l.limit += initialItems
+	b.renderList()
+}
+
+// onScroll loads more rows once the view is less than a page away from
+// the end of the list.
+func (b *BBClip) onScroll(vadj *gtk.Adjustment) {
+	if vadj.GetValue()+2*vadj.GetPageSize() >= vadj.GetUpper() {
+		b.loadMore()
+	}
+}
+
+// updateHeader shows the "Pinned" header above the first pinned row and
+// a separator between the pinned and the other rows.
+func (b *BBClip) updateHeader(row *gtk.ListBoxRow, before *gtk.ListBoxRow) {
+	r := b.entriesList.rowOf(row)
+	if r == nil {
+		return
+	}
+
+	kind := headerNone
+	// the pinned section makes no sense in a sorted result
+	if b.entriesList.filter.IsEmpty() {
+		var prev *entryRow
+		if before != nil {
+			prev = b.entriesList.rowOf(before)
+		}
+
+		switch {
+		case r.entry.pinned && prev == nil:
+			kind = headerPinned
+		case !r.entry.pinned && prev != nil && prev.entry.pinned:
+			kind = headerSeparator
+		}
+	}
+
+	if kind == r.headerKind {
+		return
+	}
+	r.headerKind = kind
+
+	switch kind {
+	case headerPinned:
+		header, _ := gtk.LabelNew("Pinned")
+		header.SetXAlign(0)
+		header.Show()
+		row.SetHeader(header)
+		b.addContextClass(header.ToWidget(), "entries-list-header")
+	case headerSeparator:
+		separator, _ := gtk.SeparatorNew(gtk.ORIENTATION_HORIZONTAL)
+		separator.Show()
+		row.SetHeader(separator)
+		b.addContextClass(separator.ToWidget(), "entries-list-separator")
+	default:
+		row.SetHeader(nil)
+	}
+}
+
+// rowOf returns the entry row of the given list box row
+func (l *EntriesList) rowOf(row *gtk.ListBoxRow) *entryRow {
+	if row == nil {
+		return nil
+	}
+
+	name, _ := row.GetName()
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return l.rows[id]
+}
+
+// masked returns whether the content of the entry is hidden
+func (l *EntriesList) masked(entry HistoryEntry) bool {
+	return entry.secret != "" && !l.revealed[entry.id]
+}
+
+// selected returns the entry of the selected row
+func (l *EntriesList) selected() (HistoryEntry, bool) {
+	if r := l.rowOf(l.box.GetSelectedRow()); r != nil {
+		return r.entry, true
+	}
+
+	return HistoryEntry{}, false
+}
+
+// highlight highlights the runes at the given positions of the preview
+func (r *entryRow) highlight(positions []int) {
+	if r.label == nil {
+		return
+	}
+
+	if len(positions) == 0 {
+		r.label.SetText(r.preview)
+		return
+	}
+
+	// don't highlight the dots of truncated previews
+	limit := len([]rune(r.preview))
+	if len([]rune(*r.entry.str)) > limit {
+		limit -= 3
+	}
+
+	visible := slices.DeleteFunc(slices.Clone(positions), func(pos int) bool {
+		return pos >= limit
 	})
 
-	b.goToTop()
+	r.label.SetMarkup(highlightMarkup(r.preview, visible))
 }
 
 // focusEntryList focues the clipboard history and removes focus
@@ -384,29 +763,242 @@ func (b *BBClip) focusEntryList() {
 // selectAndHide copies the selected row's content to the clipboard,
 // moves the row to the first position and hides the window afterwards.
 func (b *BBClip) selectAndHide(row *gtk.ListBoxRow) {
-	if row == nil {
+	item := b.entriesList.rowOf(row)
+	if item == nil {
 		b.window.Hide()
 		return
 	}
 
-	entry := b.entriesList.items[row.GetIndex()]
+	entry := item.entry
 
 	if *entry.str == "" {
 		b.window.Hide()
 		return
 	}
 
-	if ok, index := b.history.contains(*entry.str); ok {
-		entries := b.history.entries
-		b.history.entries = slices.Delete(entries, index, index+1)
-		b.history.entries = append(b.history.entries, entry)
+	if err := b.client.Copy(entry.id); err != nil {
+		println("Could not write to clipboard:", err.Error())
+	}
+
+	if !b.sticky {
+		b.window.Hide()
+	}
+}
+
+// toggleSticky toggles whether the window stays open after copying an
+// entry, so that several entries can be copied in succession.
+func (b *BBClip) toggleSticky() {
+	b.sticky = !b.sticky
+
+	if b.sticky {
+		b.addContextClass(b.windowWrapper.ToWidget(), "sticky")
+	} else {
+		b.removeContextClass(b.windowWrapper.ToWidget(), "sticky")
+	}
+}
+
+// togglePause pauses capturing the clipboard until it's resumed or
+// resumes it
+func (b *BBClip) togglePause() {
+	paused, _, err := b.client.Paused()
+	if err == nil {
+		if paused {
+			err = b.client.Resume()
+		} else {
+			err = b.client.Pause(0)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Could not pause capturing:", err)
+	}
+
+	b.updatePaused()
+}
+
+// updatePaused shows the pause indicator while capturing is paused. If
+// it resumes automatically the indicator is updated at that time.
+func (b *BBClip) updatePaused() {
+	paused, until, err := b.client.Paused()
+	if err != nil {
+		fmt.Println("Could not get pause state:", err)
+	}
+
+	if b.resumeTimeout != 0 {
+		glib.SourceRemove(b.resumeTimeout)
+		b.resumeTimeout = 0
+	}
+
+	if !paused {
+		b.pausedLabel.Hide()
+		b.removeContextClass(b.windowWrapper.ToWidget(), "paused")
+		return
+	}
+
+	text := "Recording paused"
+	if !until.IsZero() {
+		text += " until " + until.Format(time.TimeOnly)
+
+		b.resumeTimeout = glib.TimeoutAdd(uint(max(time.Until(until).Milliseconds(), 0))+100, func() bool {
+			b.resumeTimeout = 0
+			b.updatePaused()
+			return false
+		})
+	}
+
+	b.pausedLabel.SetText(text)
+	b.pausedLabel.Show()
+	b.addContextClass(b.windowWrapper.ToWidget(), "paused")
+}
+
+// toggleReveal shows or masks the content of the selected masked entry
+func (b *BBClip) toggleReveal() {
+	l := b.entriesList
+
+	entry, ok := l.selected()
+	if !ok || entry.secret == "" {
+		return
+	}
+
+	l.revealed[entry.id] = !l.revealed[entry.id]
+
+	// rebuild the row with the new preview
+	if item, ok := l.rows[entry.id]; ok {
+		b.dropRow(item)
+	}
+	b.renderList()
+	b.selectEntry(entry.id)
+}
+
+// setLocked turns the search entry into a passphrase entry while the
+// history is locked and back into the search entry once it's unlocked.
+func (b *BBClip) setLocked(locked bool) {
+	b.locked = locked
+	b.search.SetText("")
+	b.search.SetVisibility(!locked)
+	b.showSearchError(nil)
+
+	if !locked {
+		b.search.SetIconFromIconName(gtk.ENTRY_ICON_PRIMARY, "system-search")
+		b.search.SetPlaceholderText("Search...")
+		b.removeContextClass(b.search.ToWidget(), "locked")
+		return
+	}
+
+	b.search.SetIconFromIconName(gtk.ENTRY_ICON_PRIMARY, "changes-prevent-symbolic")
+	b.search.SetPlaceholderText("Passphrase...")
+	b.addContextClass(b.search.ToWidget(), "locked")
+	b.search.SetCanFocus(true)
+	b.search.GrabFocus()
+}
+
+// unlockHistory unlocks the history with the passphrase typed into the
+// search entry. A wrong passphrase is shown like an invalid query.
+func (b *BBClip) unlockHistory() {
+	passphrase, _ := b.search.GetText()
+
+	if err := b.client.Unlock(passphrase); err != nil {
+		b.showSearchError(err)
+		return
+	}
+
+	b.refreshEntryList()
+	b.goToTop()
+}
+
+// lockHistory locks an encrypted history and clears the list
+func (b *BBClip) lockHistory() {
+	if err := b.client.Lock(); err != nil {
+		fmt.Println("Could not lock history:", err)
+		return
+	}
+
+	b.refreshEntryList()
+}
+
+// applyChange updates the list of a visible window after the history
+// has changed. Only the affected row is added, moved or removed, the
+// search query and the selected entry are kept.
+func (b *BBClip) applyChange(change HistoryChange) {
+	l := b.entriesList
+	if l == nil || !b.window.IsVisible() {
+		// the list is rebuilt when the window is shown
+		return
+	}
+
+	if change.Kind == PauseChanged {
+		b.updatePaused()
+		return
+	}
+
+	selected, hasSelection := l.selected()
+	selectedIndex := -1
+	if hasSelection {
+		selectedIndex = l.box.GetSelectedRow().GetIndex()
+	}
+
+	entry := change.Entry
+	index := slices.IndexFunc(l.entries, func(e HistoryEntry) bool {
+		return e.id == entry.id
+	})
+	item, cached := l.rows[entry.id]
+
+	switch change.Kind {
+	case EntryAdded, EntryMoved:
+		if index >= 0 {
+			l.entries = slices.Delete(l.entries, index, index+1)
+		}
+		l.entries = slices.Insert(l.entries, 0, entry)
+
+	case EntryUpdated:
+		if index >= 0 {
+			l.entries[index] = entry
+		}
+		// rebuild the row since e.g. the pin icon has changed
+		if cached {
+			b.dropRow(item)
+		}
+
+	case EntryRemoved:
+		if index >= 0 {
+			l.entries = slices.Delete(l.entries, index, index+1)
+		}
+		if cached {
+			b.dropRow(item)
+		}
+		delete(l.thumbs, entry.id)
+	}
+
+	b.renderList()
+
+	if !hasSelection || b.selectEntry(selected.id) {
+		return
 	}
 
-	if err := b.history.WriteToClipboard(entry); err != nil {
-		println("Could not write to clipboard:", err)
+	// the selected entry was removed, select the row that took its place
+	rowCount := int(l.box.GetChildren().Length())
+	if rowCount == 0 {
+		return
 	}
 
-	b.window.Hide()
+	row := l.box.GetRowAtIndex(Clamp(selectedIndex, 0, rowCount-1))
+	if row.IsVisible() {
+		l.box.SelectRow(row)
+	}
+}
+
+// selectEntry selects the row of the entry with the given id and
+// returns false if there is none.
+func (b *BBClip) selectEntry(id uint64) bool {
+	item, ok := b.entriesList.rows[id]
+	if !ok || !item.attached {
+		return false
+	}
+
+	b.entriesList.box.SelectRow(item.row)
+	b.repositionView()
+
+	return true
 }
 
 // deleteSelectedRow removes the selected row from the clipboard history
@@ -417,29 +1009,28 @@ func (b *BBClip) deleteSelectedRow() {
 		return
 	}
 
-	row := b.entriesList.box.GetSelectedRow()
-	if row == nil {
+	entry, ok := b.entriesList.selected()
+	if !ok {
 		return
 	}
 
-	rowIndex := row.GetIndex()
-	rowName, _ := row.GetName()
-	entryIndex, _ := strconv.Atoi(rowName)
-
-	if index, _ := b.history.removeEntry(entryIndex); index > -1 {
-		b.refreshEntryList(0, b.history.maxEntries)
-
-		if len(b.history.entries) == 0 {
-			return
-		}
+	// the row is removed by applyChange
+	if err := b.client.Delete(entry.id); err != nil {
+		fmt.Println("Could not delete entry:", err)
+	}
+}
 
-		// move the selection to the same spot the deletion took place
-		rowIndex = Clamp(rowIndex, 0, len(b.history.entries)-1)
-		prevRow := b.entriesList.box.GetRowAtIndex(rowIndex)
+// togglePinSelectedRow pins or unpins the selected row and keeps it
+// selected after it was moved to or out of the pinned section.
+func (b *BBClip) togglePinSelectedRow() {
+	entry, ok := b.entriesList.selected()
+	if !ok {
+		return
+	}
 
-		if prevRow.IsVisible() {
-			b.entriesList.box.SelectRow(prevRow)
-		}
+	// the row is moved by applyChange
+	if err := b.client.Pin(entry.id, !entry.pinned); err != nil {
+		fmt.Println("Could not pin entry:", err)
 	}
 }
 
@@ -481,6 +1072,11 @@ func (b *BBClip) rowDown() {
 	index := selectedRow.GetIndex()
 	rowCount := int(b.entriesList.box.GetChildren().Length())
 
+	if index == rowCount-1 {
+		b.loadMore()
+		rowCount = int(b.entriesList.box.GetChildren().Length())
+	}
+
 	// look for visible lines only
 	for nextIndex := index + 1; nextIndex < rowCount; nextIndex++ {
 		nextRow := b.entriesList.box.GetRowAtIndex(nextIndex)
@@ -563,126 +1159,209 @@ func (b *BBClip) repositionView() {
 }
 
 // refreshEntryList fetches the latest clipboard entries from the history,
-// rebuilds the clipboard history list and automatically sets focus
-// to the history list
-func (b *BBClip) refreshEntryList(from int, to int) {
-	b.history.mu.RLock()
-	defer b.history.mu.RUnlock()
-
+// resets the search and automatically sets focus to the history list.
+// Rows of entries that haven't changed are reused.
+func (b *BBClip) refreshEntryList() {
 	if b.entriesList == nil {
 		return
 	}
 
-	// if from is greater than zero we're most likely want to append
-	// to the existing list rather than rebuilding
-	if from == 0 {
-		children := b.entriesList.box.GetChildren()
-		for e := children; e != nil; e = e.Next() {
-			child := e.Data().(*gtk.Widget)
-			b.entriesList.box.Remove(child)
-			child.Destroy()
+	l := b.entriesList
+
+	// the entries are in reversed order so that we can display the
+	// last added history entry as the first item
+	entries, err := b.client.List(0)
+	if err != nil {
+		fmt.Println("Could not load history:", err)
+		return
+	}
+
+	current := make(map[uint64]HistoryEntry, len(entries))
+	for _, entry := range entries {
+		current[entry.id] = entry
+	}
+
+	for id, item := range l.rows {
+		entry, ok := current[id]
+		if !ok || entry.pinned != item.entry.pinned || *entry.str != *item.entry.str {
+			b.dropRow(item)
 		}
 	}
 
-	// get a copy of the entries in reversed order so that we can
-	// display the last added history entry as the first item
-	entries := Reverse(b.history.entries)
+	for id := range l.thumbs {
+		if _, ok := current[id]; !ok {
+			delete(l.thumbs, id)
+		}
+	}
 
-	for i := range entries {
-		// skip certain entries
-		if i < from || i > to {
-			continue
+	// secrets are masked again every time the window is shown
+	for id := range l.revealed {
+		if item, ok := l.rows[id]; ok {
+			b.dropRow(item)
 		}
+	}
+	clear(l.revealed)
 
-		preview := strings.ReplaceAll(*entries[i].str, "\n", "↲")
-		// truncate the preview
-		textLength := b.conf.IntVal(TextPreviewLen, *flagTextPreviewLength)
-		preview = TruncateText(preview, textLength)
+	l.entries = entries
+	l.filter = &Filter{}
+	l.limit = initialItems
+	b.renderList()
 
-		// the real clipboard entry
-		entry := entries[i]
-		isImg := entry.img != nil
+	l.box.GrabFocus()
+	b.search.SetCanFocus(false)
+	b.search.SetText("")
 
-		rowBox, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 0)
+	locked, err := b.client.Locked()
+	if err != nil {
+		fmt.Println("Could not get history state:", err)
+	}
+	b.setLocked(locked)
+}
 
-		iconName := "text-x-generic-symbolic"
-		if isImg {
-			iconName = "image-x-generic-symbolic"
+// rowFor returns the cached row of the entry or creates it
+func (b *BBClip) rowFor(entry HistoryEntry) *entryRow {
+	if item, ok := b.entriesList.rows[entry.id]; ok {
+		return item
+	}
+
+	item := b.newEntryRow(entry)
+	if item != nil {
+		b.entriesList.rows[entry.id] = item
+	}
+
+	return item
+}
+
+// newEntryRow creates the row widget of the entry
+func (b *BBClip) newEntryRow(entry HistoryEntry) *entryRow {
+	// single line and truncated preview
+	preview := entryPreview(entry, previewLength(b.conf))
+	if entry.secret != "" && b.entriesList.revealed[entry.id] {
+		preview = textPreview(entry, previewLength(b.conf))
+	}
+	isImg := entry.img != nil
+
+	rowBox, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 0)
+	item := &entryRow{entry: entry, preview: preview}
+
+	iconName := "text-x-generic-symbolic"
+	if isImg {
+		iconName = "image-x-generic-symbolic"
+	}
+
+	imageSupport := b.conf.BoolVal(ImageSupport, *flagImageSupport)
+	if imageSupport && isImg && b.conf.BoolVal(ImagePreview, *flagImagePreview) {
+		// get local filepath
+		parsedUrl, err := url.Parse(*entry.str)
+		if err != nil {
+			return nil
 		}
 
-		imageSupport := b.conf.BoolVal(ImageSupport, *flagImageSupport)
-		if imageSupport && isImg && b.conf.BoolVal(ImagePreview, *flagImagePreview) {
-			// get local filepath
-			parsedUrl, err := url.Parse(*entry.str)
-			if err != nil {
-				continue
-			}
+		imgPath := parsedUrl.Path
 
-			imgPath := parsedUrl.Path
+		// if there's an Image object that get that path
+		if entry.img.path != "" {
+			imgPath = entry.img.path
+		}
 
-			// if there's an Image object that get that path
-			if entry.img.path != "" {
-				imgPath = entry.img.path
-			}
+		img, err := b.createEntryImage(
+			entry.id,
+			imgPath,
+			b.conf.IntVal(ImageHeight, *flagImageHeight),
+		)
+		if err == nil {
+			rowBox.PackEnd(img, true, true, 8)
+		}
+	} else {
+		label, _ := gtk.LabelNew(preview)
+		label.SetLineWrap(true)
+		label.SetLineWrapMode(pango.WRAP_WORD_CHAR)
+		label.SetMarginTop(6)
+		label.SetMarginBottom(6)
+		label.SetXAlign(0)
+		rowBox.PackEnd(label, true, true, 8)
+		b.addContextClass(label.ToWidget(), "entries-list-row-label")
+		item.label = label
+	}
 
-			img, err := b.createEntryImage(
-				imgPath,
-				b.conf.IntVal(ImageHeight, *flagImageHeight),
-			)
-			if err == nil {
-				rowBox.PackEnd(img, true, true, 8)
-			}
-		} else {
-			label, _ := gtk.LabelNew(preview)
-			label.SetLineWrap(true)
-			label.SetLineWrapMode(pango.WRAP_WORD_CHAR)
-			label.SetMarginTop(6)
-			label.SetMarginBottom(6)
-			label.SetXAlign(0)
-			rowBox.PackEnd(label, true, true, 8)
-			b.addContextClass(label.ToWidget(), "entries-list-row-label")
-		}
-
-		if b.conf.BoolVal(Icons, *flagIcons) {
-			icon, _ := gtk.ImageNewFromIconName(iconName, gtk.ICON_SIZE_BUTTON)
-			if !isImg {
-				icon.SetVAlign(gtk.ALIGN_START)
-				icon.SetMarginTop(6)
-			}
-			rowBox.PackStart(icon, false, false, 0)
-			b.addContextClass(icon.ToWidget(), "entries-list-row-icon")
+	if b.conf.BoolVal(Icons, *flagIcons) {
+		icon, _ := gtk.ImageNewFromIconName(iconName, gtk.ICON_SIZE_BUTTON)
+		if !isImg {
+			icon.SetVAlign(gtk.ALIGN_START)
+			icon.SetMarginTop(6)
 		}
+		rowBox.PackStart(icon, false, false, 0)
+		b.addContextClass(icon.ToWidget(), "entries-list-row-icon")
+	}
 
-		row, _ := gtk.ListBoxRowNew()
-		row.SetName(strconv.Itoa(i))
-		row.Add(rowBox)
-		row.ShowAll()
+	if entry.pinned {
+		icon, _ := gtk.ImageNewFromIconName("view-pin-symbolic", gtk.ICON_SIZE_BUTTON)
+		icon.SetVAlign(gtk.ALIGN_START)
+		icon.SetMarginTop(6)
+		rowBox.PackEnd(icon, false, false, 4)
+		b.addContextClass(icon.ToWidget(), "entries-list-row-pin")
+	}
 
-		b.addContextClass(row.ToWidget(), "entries-list-row")
+	row, _ := gtk.ListBoxRowNew()
+	row.SetName(strconv.FormatUint(entry.id, 10))
+	row.Add(rowBox)
+	row.ShowAll()
+	item.row = row
 
-		b.entriesList.box.Add(row)
-		b.entriesList.items[row.GetIndex()] = entry
+	b.addContextClass(row.ToWidget(), "entries-list-row")
+	if entry.pinned {
+		b.addContextClass(row.ToWidget(), "entries-list-row-pinned")
+	}
+	if entry.ephemeral {
+		b.addContextClass(row.ToWidget(), "entries-list-row-ephemeral")
+	}
+	if entry.secret != "" {
+		b.addContextClass(row.ToWidget(), "entries-list-row-secret")
 	}
 
-	b.entriesList.box.GrabFocus()
-	b.search.SetCanFocus(false)
-	b.search.SetText("")
+	return item
 }
 
-func (b *BBClip) createEntryImage(imgPath string, height int) (*gtk.Image, error) {
-	pixbuf, err := gdk.PixbufNewFromFile(imgPath)
-	if err != nil {
-		return nil, err
+// detachRow removes the row from the list box but keeps its widgets
+func (b *BBClip) detachRow(item *entryRow) {
+	b.entriesList.box.Remove(item.row)
+	item.attached = false
+	// the list box destroys the header of removed rows
+	item.headerKind = headerNone
+}
+
+// dropRow removes the row from the list box and the cache and destroys
+// its widgets
+func (b *BBClip) dropRow(item *entryRow) {
+	if item.attached {
+		b.detachRow(item)
 	}
 
-	w := pixbuf.GetWidth()
-	h := pixbuf.GetHeight()
+	item.row.Destroy()
+	delete(b.entriesList.rows, item.entry.id)
+}
+
+// createEntryImage creates the image preview of an entry. The scaled
+// image is cached by entry id so that it's only decoded once.
+func (b *BBClip) createEntryImage(id uint64, imgPath string, height int) (*gtk.Image, error) {
+	scaledPixBuf, ok := b.entriesList.thumbs[id]
 
-	scale := float64(height) / float64(h)
-	w = int(float64(w) * scale)
-	h = height
+	if !ok {
+		pixbuf, err := gdk.PixbufNewFromFile(imgPath)
+		if err != nil {
+			return nil, err
+		}
 
-	scaledPixBuf, _ := pixbuf.ScaleSimple(w, h, gdk.INTERP_BILINEAR)
+		w := pixbuf.GetWidth()
+		h := pixbuf.GetHeight()
+
+		scale := float64(height) / float64(h)
+		w = int(float64(w) * scale)
+		h = height
+
+		scaledPixBuf, _ = pixbuf.ScaleSimple(w, h, gdk.INTERP_BILINEAR)
+		b.entriesList.thumbs[id] = scaledPixBuf
+	}
 
 	img, _ := gtk.ImageNewFromPixbuf(scaledPixBuf)
 	img.SetHAlign(gtk.ALIGN_START)
@@ -751,13 +1430,22 @@ func (b *BBClip) addContextClass(widget *gtk.Widget, className string) {
 	}
 }
 
+func (b *BBClip) removeContextClass(widget *gtk.Widget, className string) {
+	if sctx, err := widget.GetStyleContext(); err == nil {
+		sctx.RemoveClass(className)
+	}
+}
+
 func (b *BBClip) onKeyPress(_ *gtk.Window, ev *gdk.Event) bool {
 	return b.handleKeyEvents(gdk.EventKeyNewFromEvent(ev))
 }
 
 func (b *BBClip) onFocusOut(win *gtk.Window, _ *gdk.Event) {
+	if b.sticky || !b.conf.BoolVal(CloseOnBlur, *flagCloseOnBlur) {
+		return
+	}
+
 	if time.Since(b.visTime) > 200*time.Millisecond {
-		// @todo config option close-on-blur = false
 		win.Hide()
 		fmt.Println("Window lost focus")
 	}
@@ -773,28 +1461,79 @@ func (b *BBClip) onButtonPress(entry *gtk.Entry, ev *gdk.Event) bool {
 	return false
 }
 
+// showSearchError shows the error as icon with tooltip inside the
+// search entry or removes it if err is nil.
+func (b *BBClip) showSearchError(err error) {
+	style, styleErr := b.search.GetStyleContext()
+	if styleErr != nil {
+		return
+	}
+
+	if err == nil {
+		b.search.SetIconFromIconName(gtk.ENTRY_ICON_SECONDARY, "")
+		style.RemoveClass("search-error")
+		return
+	}
+
+	b.search.SetIconFromIconName(gtk.ENTRY_ICON_SECONDARY, "dialog-error-symbolic")
+	b.search.SetIconTooltipText(gtk.ENTRY_ICON_SECONDARY, err.Error())
+	style.AddClass("search-error")
+}
+
 func (b *BBClip) onKeyRelease(entry *gtk.Entry, ev *gdk.Event) bool {
+	if b.locked {
+		return false
+	}
+
 	searchQuery, _ := entry.GetText()
-	// @todo make ignoreCase a config option `ignore-case = true`
-	b.searchAndFocus(searchQuery, true)
+	b.runSearch(searchQuery)
 	return false
 }
 
+// runSearch filters the list by the query using the configured case
+// sensitivity
+func (b *BBClip) runSearch(query string) {
+	ignoreCase := resolveIgnoreCase(b.conf.StringVal(IgnoreCase, *flagIgnoreCase), query)
+	b.searchAndFocus(query, ignoreCase)
+}
+
 // tryConnectSocket attempts to connect to the Unix domain socket
 // server and send a "SHOW" command.
-// Returns true if the connection and write succeed, false otherwise.
-func tryConnectSocket() bool {
-	conn, err := net.Dial("unix", socketPath)
+// shown is true if the window of the running instance was shown. daemon
+// is true if a daemon is running without user interface. Any other error,
+// e.g. if the socket belongs to another user, is returned.
+func tryConnectSocket(path string) (shown bool, daemon bool, err error) {
+	resp, _, err := SocketRequest(path, "SHOW")
+
+	switch {
+	case err == nil:
+		return true, false, nil
+	case resp != nil && resp.Code == CodeUnavailable:
+		return false, true, nil
+	case errors.Is(err, ErrNotRunning):
+		return false, false, nil
+	}
+
+	return false, false, err
+}
 
+// pinEntry pins or unpins the entry given by --pin or --unpin. If bbclip
+// is not running the history file is modified directly.
+func pinEntry() {
+	client, err := NewHistoryClient(NewConfig())
 	if err != nil {
-		fmt.Println(err)
-		return false
+		log.Fatal(err)
 	}
 
-	defer conn.Close()
-	conn.Write([]byte("SHOW\n"))
+	if *flagUnpin > 0 {
+		err = client.Pin(*flagUnpin, false)
+	} else {
+		err = client.Pin(*flagPin, true)
+	}
 
-	return true
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 func printVersion() {
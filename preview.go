@@ -84,8 +84,10 @@ func (p *Preview) toggle() {
 }
 
 func (p *Preview) update() error {
-	row := p.entriesList.box.GetSelectedRow()
-	entry := p.entriesList.items[row.GetIndex()]
+	entry, ok := p.entriesList.selected()
+	if !ok {
+		return nil
+	}
 
 	p.scrolledWin.Hide()
 	p.imgBox.Hide()
@@ -144,6 +146,12 @@ func (p *Preview) update() error {
 		}
 
 		p.scrolledWin.ShowAll()
+
+		if p.entriesList.masked(entry) {
+			p.textBuffer.SetText(maskSecret(entry) + "\n\nPress r to reveal")
+			return nil
+		}
+
 		p.textBuffer.SetText(*entry.str)
 	}
 
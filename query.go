@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Filter is a parsed search query. A query consists of space separated
+// terms which all have to match (AND):
+//
+//	/regex/     the entry matches the regular expression
+//	type:image  the entry is an image, type:text for text entries
+//	is:pinned   the entry is pinned
+//	after:2h    the entry was used within the last two hours, also
+//	            accepts days (3d), weeks (1w) or dates (2024-01-31)
+//	before:2h   the entry was used before that
+//	len>500     the entry is longer than 500 characters, also <, <=,
+//	            >=, and =
+//
+// Every other term is matched against the entry text using the
+// configured search mode.
+type Filter struct {
+	text       string
+	regexes    []*regexp.Regexp
+	predicates []func(entry HistoryEntry) bool
+}
+
+var lenTerm = regexp.MustCompile(`^len(<=|>=|<|>|=)(\d+)$`)
+
+// ParseQuery parses the query into a filter
+func ParseQuery(query string, ignoreCase bool) (*Filter, error) {
+	filter := &Filter{}
+	words := []string{}
+	now := time.Now()
+
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		// regular expressions may contain spaces, so they're terminated
+		// by the next unescaped slash instead
+		if strings.HasPrefix(query, "/") {
+			end := regexEnd(query)
+			if end < 0 {
+				return nil, errors.New("Unterminated regular expression")
+			}
+
+			expr := query[1:end]
+			if ignoreCase {
+				expr = "(?i)" + expr
+			}
+
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid regular expression: %s", err)
+			}
+
+			filter.regexes = append(filter.regexes, regex)
+			query = query[end+1:]
+			continue
+		}
+
+		term, rest, _ := strings.Cut(query, " ")
+		query = rest
+
+		predicate, err := parseTerm(term, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if predicate != nil {
+			filter.predicates = append(filter.predicates, predicate)
+		} else {
+			words = append(words, term)
+		}
+	}
+
+	filter.text = strings.Join(words, " ")
+
+	return filter, nil
+}
+
+// parseTerm parses a field qualified term. It returns nil if the term
+// is plain text.
+func parseTerm(term string, now time.Time) (func(entry HistoryEntry) bool, error) {
+	if m := lenTerm.FindStringSubmatch(term); m != nil {
+		length, _ := strconv.Atoi(m[2])
+		return lengthPredicate(m[1], length), nil
+	}
+
+	field, value, ok := strings.Cut(term, ":")
+	if !ok {
+		return nil, nil
+	}
+
+	switch field {
+	case "type":
+		switch value {
+		case "image":
+			return func(entry HistoryEntry) bool { return entry.img != nil }, nil
+		case "text":
+			return func(entry HistoryEntry) bool { return entry.img == nil }, nil
+		}
+		return nil, fmt.Errorf("Unknown type %q, expected image or text", value)
+
+	case "is":
+		if value == "pinned" {
+			return func(entry HistoryEntry) bool { return entry.pinned }, nil
+		}
+		return nil, fmt.Errorf("Unknown value %q, expected is:pinned", value)
+
+	case "after", "before":
+		since, err := parseTime(value, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "after" {
+			return func(entry HistoryEntry) bool { return entry.lastUsed.After(since) }, nil
+		}
+		return func(entry HistoryEntry) bool { return entry.lastUsed.Before(since) }, nil
+	}
+
+	// anything else, e.g. urls, is plain text
+	return nil, nil
+}
+
+func lengthPredicate(op string, length int) func(entry HistoryEntry) bool {
+	return func(entry HistoryEntry) bool {
+		l := utf8.RuneCountInString(*entry.str)
+
+		switch op {
+		case "<":
+			return l < length
+		case "<=":
+			return l <= length
+		case ">":
+			return l > length
+		case ">=":
+			return l >= length
+		}
+		return l == length
+	}
+}
+
+// parseTime parses a duration relative to now, like 30m, 2h, 3d or 1w,
+// or a date like 2024-01-31.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if date, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return date, nil
+	}
+
+	unit := value[max(len(value)-1, 0):]
+	days := map[string]int{"d": 1, "w": 7}
+
+	if factor, ok := days[unit]; ok {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid time %q", value)
+		}
+		return now.AddDate(0, 0, -n*factor), nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q", value)
+	}
+
+	return now.Add(-duration), nil
+}
+
+// regexEnd returns the index of the slash terminating the regular
+// expression at the start of query or -1.
+func regexEnd(query string) int {
+	for i := 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '/':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Match matches the entry against all terms of the filter. The text is
+// matched using the given search mode, the positions of the regular
+// expression matches are added to the positions of the text match.
+func (f *Filter) Match(entry HistoryEntry, mode string, ignoreCase bool) (Match, bool) {
+	for _, predicate := range f.predicates {
+		if !predicate(entry) {
+			return Match{}, false
+		}
+	}
+
+	match, ok := matchQuery(mode, f.text, *entry.str, ignoreCase)
+	if !ok {
+		return Match{}, false
+	}
+
+	for _, regex := range f.regexes {
+		loc := regex.FindStringIndex(*entry.str)
+		if loc == nil {
+			return Match{}, false
+		}
+
+		start := utf8.RuneCountInString((*entry.str)[:loc[0]])
+		length := utf8.RuneCountInString((*entry.str)[loc[0]:loc[1]])
+
+		match.Positions = append(match.Positions, positionRange(start, length)...)
+	}
+
+	if len(f.regexes) > 0 {
+		slices.Sort(match.Positions)
+		match.Positions = slices.Compact(match.Positions)
+	}
+
+	return match, true
+}
+
+// IsEmpty returns whether the filter matches every entry
+func (f *Filter) IsEmpty() bool {
+	return f.text == "" && len(f.regexes) == 0 && len(f.predicates) == 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		text       string
+		regexes    int
+		predicates int
+		wantErr    bool
+	}{
+		{name: "empty", query: "  "},
+		{name: "words", query: "foo  bar", text: "foo bar"},
+		{name: "regex", query: "/fo+/", regexes: 1},
+		{name: "regex with spaces", query: "/a b/ c", text: "c", regexes: 1},
+		{name: "escaped slash", query: `/a\/b/`, regexes: 1},
+		{name: "several regexes", query: "/foo/ /bar/", regexes: 2},
+		{name: "fields", query: "type:image is:pinned after:2h len>5 x", text: "x", predicates: 4},
+		{name: "url is text", query: "https://example.com", text: "https://example.com"},
+		{name: "unterminated regex", query: "/foo", wantErr: true},
+		{name: "invalid regex", query: "/(/", wantErr: true},
+		{name: "unknown type", query: "type:video", wantErr: true},
+		{name: "unknown is", query: "is:secret", wantErr: true},
+		{name: "invalid time", query: "after:soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := ParseQuery(tt.query, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseQuery(%q) succeeded, want error", tt.query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseQuery(%q): %v", tt.query, err)
+			}
+
+			if filter.text != tt.text {
+				t.Errorf("text = %q, want %q", filter.text, tt.text)
+			}
+			if len(filter.regexes) != tt.regexes {
+				t.Errorf("regexes = %d, want %d", len(filter.regexes), tt.regexes)
+			}
+			if len(filter.predicates) != tt.predicates {
+				t.Errorf("predicates = %d, want %d", len(filter.predicates), tt.predicates)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	now := time.Now()
+
+	entry := func(text string, pinned bool, lastUsed time.Time) HistoryEntry {
+		e := NewHistoryEntry(text, nil, lastUsed)
+		e.pinned = pinned
+		return e
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		entry      HistoryEntry
+		ignoreCase bool
+		want       bool
+		positions  []int
+	}{
+		{name: "empty", query: "", entry: entry("abc", false, now), want: true},
+		{name: "substring", query: "bc", entry: entry("abcd", false, now), want: true, positions: []int{1, 2}},
+		{name: "case", query: "BC", entry: entry("abcd", false, now), want: false},
+		{name: "ignore case", query: "BC", entry: entry("abcd", false, now), ignoreCase: true, want: true, positions: []int{1, 2}},
+		{name: "regex", query: "/b.d/", entry: entry("abcd", false, now), want: true, positions: []int{1, 2, 3}},
+		{name: "all regexes", query: "/foo/ /bar/", entry: entry("foo bar", false, now), want: true, positions: []int{0, 1, 2, 4, 5, 6}},
+		{name: "one regex missing", query: "/foo/ /bar/", entry: entry("foo", false, now), want: false},
+		{name: "pinned", query: "is:pinned", entry: entry("abc", true, now), want: true},
+		{name: "not pinned", query: "is:pinned", entry: entry("abc", false, now), want: false},
+		{name: "text", query: "type:text", entry: entry("abc", false, now), want: true},
+		{name: "image", query: "type:image", entry: entry("abc", false, now), want: false},
+		{name: "after", query: "after:1h", entry: entry("abc", false, now.Add(-time.Minute)), want: true},
+		{name: "not after", query: "after:1h", entry: entry("abc", false, now.Add(-2*time.Hour)), want: false},
+		{name: "before", query: "before:1d", entry: entry("abc", false, now.Add(-48*time.Hour)), want: true},
+		{name: "length", query: "len>=3", entry: entry("äbc", false, now), want: true},
+		{name: "too short", query: "len>3", entry: entry("äbc", false, now), want: false},
+		{name: "terms and text", query: "is:pinned bc", entry: entry("abc", true, now), want: true, positions: []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := ParseQuery(tt.query, tt.ignoreCase)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q): %v", tt.query, err)
+			}
+
+			match, ok := filter.Match(tt.entry, SearchSubstring, tt.ignoreCase)
+			if ok != tt.want {
+				t.Fatalf("Match(%q) = %v, want %v", *tt.entry.str, ok, tt.want)
+			}
+			if ok && !slices.Equal(match.Positions, tt.positions) {
+				t.Errorf("positions = %v, want %v", match.Positions, tt.positions)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "30m", want: now.Add(-30 * time.Minute)},
+		{value: "3d", want: now.AddDate(0, 0, -3)},
+		{value: "1w", want: now.AddDate(0, 0, -7)},
+		{value: "2024-01-31", want: time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)},
+		{value: "xd", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTime(tt.value, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTime(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Search modes
+const (
+	SearchSubstring = "substring"
+	SearchFuzzy     = "fuzzy"
+	SearchExactWord = "exact-word"
+)
+
+// Values of the ignore-case option
+const (
+	IgnoreCaseTrue  = "true"
+	IgnoreCaseFalse = "false"
+	// IgnoreCaseSmart ignores the case unless the query contains an upper
+	// case letter
+	IgnoreCaseSmart = "smart"
+)
+
+// Scores of the fuzzy matcher, loosely modeled after fzf
+const (
+	scoreMatch       = 16
+	bonusBoundary    = 8
+	bonusFirstChar   = 8
+	bonusConsecutive = 4
+	penaltyGapStart  = 3
+	penaltyGapExtend = 1
+)
+
+// Match is the result of matching a query against a text
+type Match struct {
+	// Score is higher the better the text matches
+	Score int
+	// Positions are the indices of the matched runes in the text
+	Positions []int
+}
+
+// matchQuery matches the query against the text using the given search
+// mode. An empty query matches everything.
+func matchQuery(mode string, query string, text string, ignoreCase bool) (Match, bool) {
+	q := foldRunes([]rune(query), ignoreCase)
+	orig := []rune(text)
+	t := foldRunes(orig, ignoreCase)
+
+	if len(q) == 0 {
+		return Match{}, true
+	}
+
+	switch mode {
+	case SearchFuzzy:
+		return fuzzyMatch(q, t, orig)
+	case SearchExactWord:
+		return exactWordMatch(q, t)
+	}
+
+	return substringMatch(q, t)
+}
+
+// substringMatch matches if the text contains the query. All matches
+// have the same score so that the original order is kept.
+func substringMatch(query, text []rune) (Match, bool) {
+	index := indexRunes(text, query, 0)
+	if index < 0 {
+		return Match{}, false
+	}
+
+	return Match{Positions: positionRange(index, len(query))}, true
+}
+
+// exactWordMatch matches if every word of the query appears as a whole
+// word in the text.
+func exactWordMatch(query, text []rune) (Match, bool) {
+	match := Match{}
+
+	for word := range strings.FieldsSeq(string(query)) {
+		w := []rune(word)
+		found := false
+
+		for from := 0; ; {
+			index := indexRunes(text, w, from)
+			if index < 0 {
+				break
+			}
+
+			end := index + len(w)
+			if (index == 0 || !isWordRune(text[index-1])) &&
+				(end == len(text) || !isWordRune(text[end])) {
+				match.Positions = append(match.Positions, positionRange(index, len(w))...)
+				found = true
+				break
+			}
+
+			from = index + 1
+		}
+
+		if !found {
+			return Match{}, false
+		}
+	}
+
+	slices.Sort(match.Positions)
+	match.Positions = slices.Compact(match.Positions)
+
+	return match, true
+}
+
+// fuzzyMatch matches if all runes of the query appear in the text in
+// the same order. It first looks for the earliest occurrence of the query
+// and then walks backwards to find the shortest window containing it.
+// Matches at word boundaries and consecutive matches score higher, gaps
+// between matched runes lower the score. orig is the text before case
+// folding which is needed to detect camel case boundaries.
+func fuzzyMatch(query, text, orig []rune) (Match, bool) {
+	qi, end := 0, -1
+	for i, r := range text {
+		if r == query[qi] {
+			qi++
+			if qi == len(query) {
+				end = i
+				break
+			}
+		}
+	}
+
+	if end < 0 {
+		return Match{}, false
+	}
+
+	start := 0
+	qi = len(query) - 1
+	for i := end; i >= 0; i-- {
+		if text[i] == query[qi] {
+			qi--
+			if qi < 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	positions := make([]int, 0, len(query))
+	qi = 0
+	for i := start; i <= end && qi < len(query); i++ {
+		if text[i] == query[qi] {
+			positions = append(positions, i)
+			qi++
+		}
+	}
+
+	score := 0
+	prev := -1
+	for i, pos := range positions {
+		score += scoreMatch
+
+		if prev >= 0 {
+			if pos == prev+1 {
+				score += bonusConsecutive
+			} else {
+				score -= penaltyGapStart + (pos-prev-2)*penaltyGapExtend
+			}
+		}
+
+		if pos == 0 || isBoundary(orig[pos-1], orig[pos]) {
+			score += bonusBoundary
+			if i == 0 {
+				score += bonusFirstChar
+			}
+		}
+
+		prev = pos
+	}
+
+	return Match{Score: score, Positions: positions}, true
+}
+
+// highlightMarkup returns the text as Pango markup with the runes at
+// the given positions highlighted.
+func highlightMarkup(text string, positions []int) string {
+	var markup strings.Builder
+	runes := []rune(text)
+	highlighted := false
+
+	for i, r := range runes {
+		match := slices.Contains(positions, i)
+
+		if match && !highlighted {
+			markup.WriteString("<b>")
+		} else if !match && highlighted {
+			markup.WriteString("</b>")
+		}
+		highlighted = match
+
+		markup.WriteString(html.EscapeString(string(r)))
+	}
+
+	if highlighted {
+		markup.WriteString("</b>")
+	}
+
+	return markup.String()
+}
+
+func indexRunes(text, sub []rune, from int) int {
+	for i := from; i+len(sub) <= len(text); i++ {
+		if slices.Equal(text[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func positionRange(from int, length int) []int {
+	positions := make([]int, length)
+	for i := range positions {
+		positions[i] = from + i
+	}
+
+	return positions
+}
+
+// resolveIgnoreCase returns whether the query should be matched ignoring the
+// case according to the ignore-case option.
+func resolveIgnoreCase(option string, query string) bool {
+	switch option {
+	case IgnoreCaseFalse:
+		return false
+	case IgnoreCaseSmart:
+		return !strings.ContainsFunc(query, unicode.IsUpper)
+	}
+
+	return true
+}
+
+// foldRunes removes diacritics from the runes, so that "cafe" matches
+// "Café", and folds the case if ignoreCase is true. Every rune is folded
+// into exactly one rune so the positions of a match are the same in the
+// original text.
+func foldRunes(runes []rune, ignoreCase bool) []rune {
+	folded := make([]rune, len(runes))
+	for i, r := range runes {
+		folded[i] = stripDiacritic(r)
+		if ignoreCase {
+			folded[i] = foldCase(folded[i])
+		}
+	}
+
+	return folded
+}
+
+// stripDiacritic returns the base rune of a precomposed rune like é
+func stripDiacritic(r rune) rune {
+	if r < unicode.MaxASCII {
+		return r
+	}
+
+	decomposed := []rune(norm.NFD.String(string(r)))
+	for _, mark := range decomposed[1:] {
+		if !unicode.Is(unicode.Mn, mark) {
+			return r
+		}
+	}
+
+	return decomposed[0]
+}
+
+// foldCase returns the same rune for all case variants of r, including
+// special ones like the Kelvin sign for K.
+func foldCase(r rune) rune {
+	folded := unicode.ToLower(r)
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		folded = min(folded, unicode.ToLower(f))
+	}
+
+	return folded
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// isBoundary returns whether cur starts a new word, either after
+// a non word rune or as upper case letter in camel case.
+func isBoundary(prev, cur rune) bool {
+	if !isWordRune(prev) {
+		return true
+	}
+
+	return unicode.IsLower(prev) && unicode.IsUpper(cur)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMatchQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		query      string
+		text       string
+		ignoreCase bool
+		want       bool
+		positions  []int
+	}{
+		{name: "substring", mode: SearchSubstring, query: "lo w", text: "hello world", want: true, positions: []int{3, 4, 5, 6}},
+		{name: "substring missing", mode: SearchSubstring, query: "low", text: "hello world", want: false},
+		{name: "accents", mode: SearchSubstring, query: "cafe", text: "Café", ignoreCase: true, want: true, positions: []int{0, 1, 2, 3}},
+		{name: "kelvin sign", mode: SearchSubstring, query: "k", text: "K", ignoreCase: true, want: true, positions: []int{0}},
+		{name: "exact word", mode: SearchExactWord, query: "world", text: "hello world", want: true, positions: []int{6, 7, 8, 9, 10}},
+		{name: "exact word inside word", mode: SearchExactWord, query: "wor", text: "hello world", want: false},
+		{name: "exact words", mode: SearchExactWord, query: "world hello", text: "hello world", want: true, positions: []int{0, 1, 2, 3, 4, 6, 7, 8, 9, 10}},
+		{name: "fuzzy", mode: SearchFuzzy, query: "hw", text: "hello world", want: true, positions: []int{0, 6}},
+		{name: "fuzzy order", mode: SearchFuzzy, query: "wh", text: "hello world", want: false},
+		{name: "fuzzy shortest window", mode: SearchFuzzy, query: "ab", text: "a xab", want: true, positions: []int{3, 4}},
+		{name: "empty query", mode: SearchFuzzy, query: "", text: "anything", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, ok := matchQuery(tt.mode, tt.query, tt.text, tt.ignoreCase)
+			if ok != tt.want {
+				t.Fatalf("matchQuery(%q, %q) = %v, want %v", tt.query, tt.text, ok, tt.want)
+			}
+			if ok && !slices.Equal(match.Positions, tt.positions) {
+				t.Errorf("positions = %v, want %v", match.Positions, tt.positions)
+			}
+		})
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	// each pair is ordered from the better to the worse match
+	tests := []struct {
+		name   string
+		query  string
+		better string
+		worse  string
+	}{
+		{name: "consecutive", query: "abc", better: "xabcx", worse: "xaxbxc"},
+		{name: "word boundary", query: "fb", better: "foo bar", worse: "xfxb"},
+		{name: "camel case", query: "gv", better: "getValue", worse: "gravel"},
+		{name: "first char", query: "ab", better: "a xb", worse: "xa b"},
+		{name: "short gap", query: "ab", better: "a-b", worse: "a----b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			better, ok := matchQuery(SearchFuzzy, tt.query, tt.better, true)
+			if !ok {
+				t.Fatalf("%q doesn't match %q", tt.query, tt.better)
+			}
+			worse, ok := matchQuery(SearchFuzzy, tt.query, tt.worse, true)
+			if !ok {
+				t.Fatalf("%q doesn't match %q", tt.query, tt.worse)
+			}
+
+			if better.Score <= worse.Score {
+				t.Errorf("score of %q = %d, want more than %d of %q",
+					tt.better, better.Score, worse.Score, tt.worse)
+			}
+		})
+	}
+}
+
+func TestResolveIgnoreCase(t *testing.T) {
+	tests := []struct {
+		option string
+		query  string
+		want   bool
+	}{
+		{option: IgnoreCaseTrue, query: "Foo", want: true},
+		{option: IgnoreCaseFalse, query: "foo", want: false},
+		{option: IgnoreCaseSmart, query: "foo", want: true},
+		{option: IgnoreCaseSmart, query: "Foo", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := resolveIgnoreCase(tt.option, tt.query); got != tt.want {
+			t.Errorf("resolveIgnoreCase(%q, %q) = %v, want %v", tt.option, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Values of the secret-action option, what is done with content that
+// one of the secret detectors matches
+const (
+	// SecretDrop doesn't add the content to the history
+	SecretDrop = "drop"
+	// SecretMask adds the content but masks it in the list and the
+	// preview until it's revealed
+	SecretMask = "mask"
+	// SecretExpire adds the content as ephemeral entry, see HintEphemeral
+	SecretExpire = "expire"
+	// SecretIgnore adds the content like any other content
+	SecretIgnore = "ignore"
+)
+
+// secretPatternsFile is the file in the config directory containing
+// additional secret patterns, one regular expression per line
+const secretPatternsFile = "secret-patterns"
+
+// secretDetector detects a single kind of secret
+type secretDetector struct {
+	name    string
+	pattern *regexp.Regexp
+	// valid checks a match of the pattern, e.g. the check digit of a
+	// credit card number. It may be nil.
+	valid func(match string) bool
+}
+
+// builtinDetectors are the detectors that can be enabled with the
+// secret-detectors option
+var builtinDetectors = []secretDetector{
+	{
+		// only numbers with the prefix of a card network, Visa,
+		// Mastercard, American Express, Discover and UnionPay, so that
+		// e.g. timestamps or order numbers aren't taken for cards
+		name:    "credit-card",
+		pattern: regexp.MustCompile(`\b(?:4\d{3}|5[1-5]\d{2}|2[2-7]\d{2}|3[47]\d{2}|6(?:011|22\d|4[4-9]\d|5\d{2}))(?:[ -]?\d){9,15}\b`),
+		valid:   luhnValid,
+	},
+	{
+		name:    "aws-key",
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		name:    "github-token",
+		pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`),
+	},
+	{
+		name:    "slack-token",
+		pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),
+	},
+	{
+		name:    "jwt",
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	},
+	{
+		name:    "private-key",
+		pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )*PRIVATE KEY(?: BLOCK)?-----`),
+	},
+}
+
+// newSecretDetectors returns the detectors enabled by the
+// secret-detectors option, a comma separated list of detector names,
+// "all" or "none", and the patterns of the secret-patterns file.
+func newSecretDetectors(conf *Config) []secretDetector {
+	detectors := []secretDetector{}
+	enabled := conf.StringVal(SecretDetectors, *flagSecretDetectors)
+
+	for name := range strings.SplitSeq(enabled, ",") {
+		name = strings.TrimSpace(name)
+
+		for _, detector := range builtinDetectors {
+			if name == "all" || name == detector.name {
+				detectors = append(detectors, detector)
+			}
+		}
+	}
+
+	confDir, err := ConfigDir()
+	if err != nil {
+		return detectors
+	}
+
+	file, err := os.Open(confDir + "/" + secretPatternsFile)
+	if err != nil {
+		return detectors
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			println("Invalid secret pattern:", err.Error())
+			continue
+		}
+
+		detectors = append(detectors, secretDetector{name: "custom", pattern: pattern})
+	}
+
+	return detectors
+}
+
+// detectSecret returns the name of the first detector matching the
+// content or an empty string.
+func detectSecret(detectors []secretDetector, content string) string {
+	for _, detector := range detectors {
+		for _, match := range detector.pattern.FindAllString(content, -1) {
+			if detector.valid == nil || detector.valid(match) {
+				return detector.name
+			}
+		}
+	}
+
+	return ""
+}
+
+// luhnValid checks the check digit of a credit card number, spaces and
+// dashes are ignored
+func luhnValid(number string) bool {
+	sum := 0
+	digits := 0
+
+	for i := len(number) - 1; i >= 0; i-- {
+		c := rune(number[i])
+		if !unicode.IsDigit(c) {
+			continue
+		}
+
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		digits++
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
+
+// maskSecret returns the text shown instead of a masked entry
+func maskSecret(entry HistoryEntry) string {
+	return "•••••••• (" + entry.secret + ")"
+}
+
+// maskedEntry returns the entry with its text replaced by the mask if
+// it's a masked secret. Masked entries are searched and printed by their
+// mask, otherwise the secret could be guessed one character at a time.
+func maskedEntry(entry HistoryEntry) HistoryEntry {
+	if entry.secret != "" {
+		mask := maskSecret(entry)
+		entry.str = &mask
+	}
+
+	return entry
+}
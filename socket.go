@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// Response codes of the socket protocol
+const (
+	CodeOK = iota
+	CodeUnknownCommand
+	CodeInvalidArgument
+	CodeNotFound
+	CodeFailed
+	CodeUnavailable
+)
+
+// maxRequestSize is the maximum length of a single request line
+const maxRequestSize = 1024 * 1024
+
+// Response is sent back as a single line of JSON for every request.
+type Response struct {
+	Ok    bool   `json:"ok"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// CommandHandler handles a single command. args is the rest of the
+// request line after the command name.
+type CommandHandler func(args string) Response
+
+// Status is the response data of the STATUS command
+type Status struct {
+	Pid        int    `json:"pid"`
+	Version    string `json:"version"`
+	Entries    int    `json:"entries"`
+	Pinned     int    `json:"pinned"`
+	MaxEntries int    `json:"max_entries"`
+	Encrypted  bool   `json:"encrypted"`
+	Locked     bool   `json:"locked"`
+	Paused     bool   `json:"paused"`
+	// PausedUntil is only set if the capture resumes automatically
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+// SocketServer serves the line based command protocol on a Unix domain
+// socket. Every request is a single line `COMMAND [ARGS]` and is answered
+// with a single line containing the JSON encoded Response. A connection
+// can be used for any number of requests.
+type SocketServer struct {
+	path     string
+	history  *History
+	listener net.Listener
+	mu       sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+// NewSocketServer creates a socket server that provides the history
+// commands. Commands that need a user interface, like SHOW, have to be
+// registered with Handle. If history is nil no history commands are
+// provided.
+func NewSocketServer(path string, history *History) *SocketServer {
+	s := &SocketServer{
+		path:     path,
+		history:  history,
+		handlers: make(map[string]CommandHandler),
+	}
+
+	if history == nil {
+		return s
+	}
+
+	s.Handle("LIST", s.list)
+	s.Handle("GET", s.withEntry(s.get))
+	s.Handle("COPY", s.withEntry(s.copy))
+	s.Handle("DELETE", s.withEntry(s.delete))
+	s.Handle("PIN", s.withEntry(s.pin(true)))
+	s.Handle("UNPIN", s.withEntry(s.pin(false)))
+	s.Handle("ADD", s.add)
+	s.Handle("CLEAR", s.clear)
+	s.Handle("SEARCH", s.search)
+	s.Handle("STATUS", s.status)
+	s.Handle("LOCK", s.lock)
+	s.Handle("UNLOCK", s.withPassphrase(s.history.Unlock))
+	s.Handle("ENCRYPT", s.encrypt)
+	s.Handle("DECRYPT", s.decrypt)
+	s.Handle("PAUSE", s.pause)
+	s.Handle("RESUME", s.resume)
+
+	return s
+}
+
+// Handle registers the handler for the given command
+func (s *SocketServer) Handle(cmd string, handler CommandHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[strings.ToUpper(cmd)] = handler
+}
+
+// Listen creates the socket and starts accepting connections in the
+// background. A stale socket file left behind by a crashed instance is
+// removed, a socket of a running instance is not.
+func (s *SocketServer) Listen() error {
+	conn, err := dialSocket(s.path)
+	if err == nil {
+		conn.Close()
+		return errors.New("Another instance is already listening on " + s.path)
+	}
+
+	if errors.Is(err, ErrStaleSocket) {
+		// Remove the socket file to avoid "address already in use" error.
+		os.Remove(s.path)
+	} else if !errors.Is(err, ErrNotRunning) {
+		return err
+	}
+
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+
+	// make sure the socket is only accessible by the current user. The
+	// umask would apply to the files of the whole process, until the mode
+	// is changed the private runtime directory and checkPeer protect it.
+	if err := os.Chmod(s.path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.listener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println("accept err:", err)
+				continue
+			}
+
+			if err := checkPeer(conn); err != nil {
+				fmt.Println("rejected connection:", err)
+				conn.Close()
+				continue
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops accepting connections and removes the socket file
+func (s *SocketServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *SocketServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxRequestSize)
+
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if err := encoder.Encode(s.dispatch(line)); err != nil {
+			// older clients just send SHOW and close the connection
+			// without waiting for a response
+			return
+		}
+	}
+}
+
+func (s *SocketServer) dispatch(line string) Response {
+	cmd, args, _ := strings.Cut(line, " ")
+
+	s.mu.RLock()
+	handler, ok := s.handlers[strings.ToUpper(cmd)]
+	s.mu.RUnlock()
+
+	if !ok {
+		return errorResponse(CodeUnknownCommand, "Unknown command "+cmd)
+	}
+
+	return handler(strings.TrimSpace(args))
+}
+
+// withEntry parses the entry id argument and passes the
+// corresponding entry to the handler.
+func (s *SocketServer) withEntry(
+	handler func(entry HistoryEntry) Response,
+) CommandHandler {
+	return func(args string) Response {
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			return errorResponse(CodeInvalidArgument, "Invalid entry id "+args)
+		}
+
+		entry, ok := s.history.get(id)
+		if !ok {
+			return errorResponse(CodeNotFound, "No entry found")
+		}
+
+		return handler(entry)
+	}
+}
+
+func (s *SocketServer) list(args string) Response {
+	entries := s.history.list()
+
+	if args != "" {
+		limit, err := strconv.Atoi(args)
+		if err != nil || limit < 0 {
+			return errorResponse(CodeInvalidArgument, "Invalid limit "+args)
+		}
+		if limit > 0 {
+			entries = entries[:min(limit, len(entries))]
+		}
+	}
+
+	return okResponse(storedEntries(entries))
+}
+
+func (s *SocketServer) get(entry HistoryEntry) Response {
+	return okResponse(entry.stored())
+}
+
+func (s *SocketServer) copy(entry HistoryEntry) Response {
+	return resultResponse(s.history.copyEntry(entry.id))
+}
+
+func (s *SocketServer) delete(entry HistoryEntry) Response {
+	return resultResponse(s.history.removeEntry(entry.id))
+}
+
+func (s *SocketServer) pin(pinned bool) func(entry HistoryEntry) Response {
+	return func(entry HistoryEntry) Response {
+		return resultResponse(s.history.setPinned(entry.id, pinned))
+	}
+}
+
+// add adds the text, given as JSON string, to the history
+func (s *SocketServer) add(args string) Response {
+	var text string
+	if err := json.Unmarshal([]byte(args), &text); err != nil || text == "" {
+		return errorResponse(CodeInvalidArgument, "Invalid text "+args)
+	}
+
+	entry := NewHistoryEntry(text, nil, time.Now())
+
+	return resultResponse(s.history.add(entry))
+}
+
+func (s *SocketServer) clear(_ string) Response {
+	return resultResponse(s.history.clear())
+}
+
+func (s *SocketServer) search(args string) Response {
+	if args == "" {
+		return errorResponse(CodeInvalidArgument, "Missing search query")
+	}
+
+	entries, err := s.history.search(args)
+	if err != nil {
+		return errorResponse(CodeInvalidArgument, err.Error())
+	}
+
+	return okResponse(storedEntries(entries))
+}
+
+func (s *SocketServer) status(_ string) Response {
+	var until time.Time
+	entries := s.history.list()
+	status := Status{
+		Pid:        os.Getpid(),
+		Version:    version,
+		Entries:    len(entries),
+		MaxEntries: s.history.maxEntries,
+		Encrypted:  s.history.isEncrypted(),
+		Locked:     s.history.isLocked(),
+	}
+
+	status.Paused, until = s.history.pauseState()
+	if !until.IsZero() {
+		status.PausedUntil = &until
+	}
+
+	for _, entry := range entries {
+		if entry.pinned {
+			status.Pinned++
+		}
+	}
+
+	return okResponse(status)
+}
+
+func (s *SocketServer) lock(_ string) Response {
+	return resultResponse(s.history.Lock())
+}
+
+// pause pauses the capture for the given duration, e.g. 10m, or until
+// it's resumed if no duration is given
+func (s *SocketServer) pause(args string) Response {
+	var duration time.Duration
+	if args != "" {
+		d, err := time.ParseDuration(args)
+		if err != nil || d < 0 {
+			return errorResponse(CodeInvalidArgument, "Invalid duration "+args)
+		}
+		duration = d
+	}
+
+	s.history.Pause(duration)
+
+	return okResponse(nil)
+}
+
+func (s *SocketServer) resume(_ string) Response {
+	s.history.Resume()
+	return okResponse(nil)
+}
+
+// encrypt encrypts the history with the passphrase, given as JSON string.
+// The response data are the paths of the unencrypted copies of damaged
+// history files that are left in place.
+func (s *SocketServer) encrypt(args string) Response {
+	var passphrase string
+	if err := json.Unmarshal([]byte(args), &passphrase); err != nil || passphrase == "" {
+		return errorResponse(CodeInvalidArgument, "Invalid passphrase")
+	}
+
+	damaged, err := s.history.Encrypt(passphrase)
+	if err != nil {
+		return resultResponse(err)
+	}
+
+	return okResponse(damaged)
+}
+
+func (s *SocketServer) decrypt(_ string) Response {
+	return resultResponse(s.history.Decrypt())
+}
+
+// withPassphrase parses the passphrase argument, given as JSON string,
+// and passes it to fn.
+func (s *SocketServer) withPassphrase(fn func(passphrase string) error) CommandHandler {
+	return func(args string) Response {
+		var passphrase string
+		if err := json.Unmarshal([]byte(args), &passphrase); err != nil || passphrase == "" {
+			return errorResponse(CodeInvalidArgument, "Invalid passphrase")
+		}
+
+		return resultResponse(fn(passphrase))
+	}
+}
+
+func okResponse(data any) Response {
+	return Response{Ok: true, Code: CodeOK, Data: data}
+}
+
+func errorResponse(code int, msg string) Response {
+	return Response{Ok: false, Code: code, Error: msg}
+}
+
+func resultResponse(err error) Response {
+	if err != nil {
+		return errorResponse(CodeFailed, err.Error())
+	}
+
+	return okResponse(nil)
+}
+
+func storedEntries(entries []HistoryEntry) []storedEntry {
+	stored := make([]storedEntry, 0, len(entries))
+	for _, entry := range entries {
+		stored = append(stored, entry.stored())
+	}
+
+	return stored
+}
+
+// SocketPath returns the path of the socket. It defaults to bbclip.sock
+// in the user's runtime directory.
+func SocketPath(conf *Config) string {
+	return conf.StringVal(Socket, *flagSocket)
+}
+
+func defaultSocketPath() string {
+	return filepath.Join(xdg.RuntimeDir, "bbclip.sock")
+}
+
+var (
+	// ErrNotRunning is returned if there is no socket to connect to
+	ErrNotRunning = errors.New("bbclip is not running")
+	// ErrStaleSocket is returned if the socket file exists but nobody is
+	// listening, e.g. because bbclip crashed.
+	ErrStaleSocket = fmt.Errorf("%w (stale socket)", ErrNotRunning)
+)
+
+// dialSocket connects to the socket at path and makes sure it's served
+// by a process of the current user.
+func dialSocket(path string) (net.Conn, error) {
+	conn, err := net.Dial("unix", path)
+
+	switch {
+	case errors.Is(err, syscall.ENOENT):
+		return nil, ErrNotRunning
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return nil, ErrStaleSocket
+	case err != nil:
+		return nil, err
+	}
+
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// checkPeer returns an error if the process on the other end of the
+// connection doesn't belong to the current user.
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("Not a unix socket connection")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("Peer belongs to uid %d", cred.Uid)
+	}
+
+	return nil
+}
+
+// SocketRequest sends a single command to the instance listening on path
+// and returns its response. The response data is left undecoded so the
+// caller can unmarshal it into the expected type.
+func SocketRequest(path string, cmd string) (*Response, json.RawMessage, error) {
+	return SocketRequestTimeout(path, cmd, 0)
+}
+
+// SocketRequestTimeout is like SocketRequest but gives up once the
+// request took longer than timeout. A zero timeout waits forever.
+func SocketRequestTimeout(path string, cmd string, timeout time.Duration) (*Response, json.RawMessage, error) {
+	conn, err := dialSocket(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return nil, nil, err
+	}
+
+	var raw struct {
+		Response
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+
+	if err := json.NewDecoder(conn).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	if !raw.Ok {
+		return &raw.Response, nil, errors.New(raw.Error)
+	}
+
+	return &raw.Response, raw.Data, nil
+}
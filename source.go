@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sourceUrlType is the mime type chromium based browsers offer along with
+// the copied content, its content is the url of the page
+const sourceUrlType = "chromium/x-source-url"
+
+// ipcTimeout is how long the compositor may take to answer, the capture
+// waits for it
+const ipcTimeout = 500 * time.Millisecond
+
+// ClipboardSource describes where the clipboard content was copied from.
+// Both fields are empty if they couldn't be resolved.
+type ClipboardSource struct {
+	// app is the app id, or the window class, of the focused window
+	app string
+	// url is the url of the page the content was copied from
+	url string
+}
+
+// IsEmpty returns whether nothing is known about the source
+func (s ClipboardSource) IsEmpty() bool {
+	return s.app == "" && s.url == ""
+}
+
+// resolveSource resolves the source of the current clipboard content.
+// The app is the focused window, which is asked from the compositor, the
+// url is taken from the offered mime types.
+func resolveSource(clipboard ClipboardBackend, types []string) ClipboardSource {
+	source := ClipboardSource{app: focusedApp()}
+
+	if slices.Contains(types, sourceUrlType) {
+		if out, err := clipboard.Read(sourceUrlType); err == nil {
+			source.url = strings.TrimSpace(string(out))
+		}
+	}
+
+	return source
+}
+
+// focusedApp returns the app id of the focused window using the IPC of
+// sway, Hyprland or niri. It returns an empty string for any other
+// compositor.
+func focusedApp() string {
+	switch {
+	case os.Getenv("SWAYSOCK") != "":
+		// sway has no query for just the focused window
+		var tree swayNode
+		if ipcJson(&tree, "swaymsg", "-t", "get_tree") {
+			return tree.focusedApp()
+		}
+
+	case os.Getenv("HYPRLAND_INSTANCE_SIGNATURE") != "":
+		var window struct {
+			Class string `json:"class"`
+		}
+		if ipcJson(&window, "hyprctl", "activewindow", "-j") {
+			return window.Class
+		}
+
+	case os.Getenv("NIRI_SOCKET") != "":
+		var window *struct {
+			AppId string `json:"app_id"`
+		}
+		if ipcJson(&window, "niri", "msg", "--json", "focused-window") && window != nil {
+			return window.AppId
+		}
+	}
+
+	return ""
+}
+
+// ipcJson runs the command and decodes its JSON output into v. The
+// command is killed if it doesn't finish within ipcTimeout.
+func ipcJson(v any, name string, args ...string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), ipcTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(out, v) == nil
+}
+
+// swayNode is a node of the sway tree, only the fields needed to find
+// the focused window are decoded
+type swayNode struct {
+	Focused          bool   `json:"focused"`
+	AppId            string `json:"app_id"`
+	WindowProperties *struct {
+		Class string `json:"class"`
+	} `json:"window_properties"`
+	Nodes         []swayNode `json:"nodes"`
+	FloatingNodes []swayNode `json:"floating_nodes"`
+}
+
+// focusedApp returns the app id of the focused window of the tree. X11
+// windows have no app id, their class is used instead.
+func (n swayNode) focusedApp() string {
+	if n.Focused {
+		if n.AppId == "" && n.WindowProperties != nil {
+			return n.WindowProperties.Class
+		}
+		return n.AppId
+	}
+
+	for _, child := range slices.Concat(n.Nodes, n.FloatingNodes) {
+		if app := child.focusedApp(); app != "" {
+			return app
+		}
+	}
+
+	return ""
+}
+
+// sourceRules decide whether content of a source is added to the
+// history. The rules are comma separated lists of glob patterns, apps
+// are matched against the app id and urls against the host name, both
+// ignoring the case.
+type sourceRules struct {
+	// includeApps are the only apps content is added from, if any
+	includeApps []string
+	excludeApps []string
+	excludeUrls []string
+}
+
+func newSourceRules(conf *Config) sourceRules {
+	return sourceRules{
+		includeApps: splitPatterns(conf.StringVal(IncludeApps, *flagIncludeApps)),
+		excludeApps: splitPatterns(conf.StringVal(ExcludeApps, *flagExcludeApps)),
+		excludeUrls: splitPatterns(conf.StringVal(ExcludeUrls, *flagExcludeUrls)),
+	}
+}
+
+// allows returns whether content of the source may be added. If apps are
+// included explicitly, content of an unknown app isn't added either.
+func (r sourceRules) allows(source ClipboardSource) bool {
+	if len(r.includeApps) > 0 && !matchesPattern(r.includeApps, source.app) {
+		return false
+	}
+
+	if matchesPattern(r.excludeApps, source.app) {
+		return false
+	}
+
+	if u, err := url.Parse(source.url); err == nil && matchesPattern(r.excludeUrls, u.Hostname()) {
+		return false
+	}
+
+	return true
+}
+
+// matchesPattern returns whether the value matches one of the patterns
+func matchesPattern(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+
+	value = strings.ToLower(value)
+
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, value)
+		return ok
+	})
+}
+
+// splitPatterns splits the comma separated patterns
+func splitPatterns(value string) []string {
+	patterns := []string{}
+	for pattern := range strings.SplitSeq(value, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestSourceRulesAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		includeApps string
+		excludeApps string
+		excludeUrls string
+		source      ClipboardSource
+		want        bool
+	}{
+		{name: "no rules", source: ClipboardSource{app: "firefox"}, want: true},
+		{name: "unknown source", excludeApps: "keepassxc", want: true},
+		{name: "excluded app", excludeApps: "keepassxc", source: ClipboardSource{app: "keepassxc"}, want: false},
+		{name: "ignoring the case", excludeApps: "KeePassXC", source: ClipboardSource{app: "org.KeePassXC"}, want: true},
+		{name: "glob", excludeApps: "org.keepassxc.*", source: ClipboardSource{app: "org.KeePassXC.KeePassXC"}, want: false},
+		{name: "list", excludeApps: " foo , keepassxc", source: ClipboardSource{app: "keepassxc"}, want: false},
+		{name: "included app", includeApps: "firefox, foot", source: ClipboardSource{app: "foot"}, want: true},
+		{name: "not included app", includeApps: "firefox, foot", source: ClipboardSource{app: "kitty"}, want: false},
+		{name: "unknown app when including", includeApps: "firefox", want: false},
+		{name: "excluded although included", includeApps: "*", excludeApps: "kitty", source: ClipboardSource{app: "kitty"}, want: false},
+		{
+			name:        "excluded host",
+			excludeUrls: "*.bank.com, bank.com",
+			source:      ClipboardSource{app: "firefox", url: "https://bank.com/login"},
+			want:        false,
+		},
+		{
+			name:        "excluded subdomain",
+			excludeUrls: "*.bank.com, bank.com",
+			source:      ClipboardSource{app: "firefox", url: "https://WWW.Bank.com"},
+			want:        false,
+		},
+		{
+			name:        "other host",
+			excludeUrls: "*.bank.com, bank.com",
+			source:      ClipboardSource{app: "firefox", url: "https://notbank.com/bank.com"},
+			want:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := sourceRules{
+				includeApps: splitPatterns(tt.includeApps),
+				excludeApps: splitPatterns(tt.excludeApps),
+				excludeUrls: splitPatterns(tt.excludeUrls),
+			}
+			if got := rules.allows(tt.source); got != tt.want {
+				t.Errorf("allows(%+v) = %v, want %v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFocusedApp(t *testing.T) {
+	tree := swayNode{Nodes: []swayNode{
+		{Nodes: []swayNode{{AppId: "foot"}}},
+		{FloatingNodes: []swayNode{{Focused: true, WindowProperties: &struct {
+			Class string `json:"class"`
+		}{Class: "Gimp"}}}},
+	}}
+
+	if got := tree.focusedApp(); got != "Gimp" {
+		t.Errorf("focusedApp() = %q, want Gimp", got)
+	}
+
+	tree.Nodes[0].Nodes[0].Focused = true
+	if got := tree.focusedApp(); got != "foot" {
+		t.Errorf("focusedApp() = %q, want foot", got)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// historyVersion is the current version of the history file format.
+// Version 1 is the legacy format which was a plain JSON array of strings.
+const historyVersion = 2
+
+// historyFile is the on-disk representation of the history
+type historyFile struct {
+	Version int `json:"version"`
+	// LastID is the highest id ever assigned, ids of deleted entries
+	// aren't assigned again
+	LastID  uint64        `json:"last_id,omitempty"`
+	Entries []storedEntry `json:"entries"`
+}
+
+type storedEntry struct {
+	ID       uint64       `json:"id"`
+	Text     string       `json:"text"`
+	Mime     string       `json:"mime"`
+	Size     int64        `json:"size"`
+	Created  time.Time    `json:"created"`
+	LastUsed time.Time    `json:"last_used"`
+	UseCount int          `json:"use_count"`
+	Pinned   bool         `json:"pinned"`
+	Hash     string       `json:"hash,omitempty"`
+	Image    *storedImage `json:"image,omitempty"`
+	// Ephemeral is only set for entries sent over the socket, ephemeral
+	// entries are never written to disk
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Secret is the name of the detector that matched a masked entry
+	Secret string        `json:"secret,omitempty"`
+	Source *storedSource `json:"source,omitempty"`
+}
+
+type storedSource struct {
+	App string `json:"app,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+type storedImage struct {
+	Source   ImageSource `json:"source"`
+	MimeType string      `json:"mime"`
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+}
+
+// storedChange is the JSON representation of a HistoryChange, used to
+// send changes over the socket
+type storedChange struct {
+	Kind  ChangeKind  `json:"kind"`
+	Entry storedEntry `json:"entry"`
+}
+
+// decodeHistory decodes the content of a history file of any known
+// version and returns its entries in chronological order along with the
+// last assigned id, which is 0 if the file doesn't record it.
+func decodeHistory(data []byte) ([]HistoryEntry, uint64, error) {
+	data = bytes.TrimSpace(data)
+
+	// a freshly created history file is empty
+	if len(data) == 0 {
+		return []HistoryEntry{}, 0, nil
+	}
+
+	if data[0] == '[' {
+		entries, err := decodeLegacyHistory(data)
+		return entries, 0, err
+	}
+
+	var file historyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return []HistoryEntry{}, 0, err
+	}
+
+	if file.Version > historyVersion {
+		return []HistoryEntry{}, 0, fmt.Errorf(
+			"Unsupported history version %d", file.Version,
+		)
+	}
+
+	entries := make([]HistoryEntry, 0, len(file.Entries))
+	for _, stored := range file.Entries {
+		entries = append(entries, stored.entry())
+	}
+
+	return entries, file.LastID, nil
+}
+
+// decodeLegacyHistory migrates the version 1 history, a plain list
+// of strings, to history entries. Since the old format didn't store
+// any metadata, ids are assigned in order and images are detected by
+// checking whether the entry is a url to an existing file.
+func decodeLegacyHistory(data []byte) ([]HistoryEntry, error) {
+	var history []string
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return []HistoryEntry{}, err
+	}
+
+	return legacyEntries(history), nil
+}
+
+func legacyEntries(history []string) []HistoryEntry {
+	now := time.Now()
+	entries := []HistoryEntry{}
+
+	for i, content := range history {
+		var img *Image = nil
+		if fileUrl, fErr := url.Parse(content); fErr == nil {
+			if fileUrl.Scheme == "file" {
+				if f, err := os.Stat(fileUrl.Path); err == nil {
+					img = &Image{
+						source:   ImageSrcFileSystem,
+						mimeType: "image/*",
+						path:     fileUrl.Path,
+						size:     f.Size(),
+					}
+				}
+			}
+		}
+
+		entry := NewHistoryEntry(content, img, now)
+		entry.id = uint64(i + 1)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// salvageHistory decodes as many entries as possible from a damaged
+// history file, e.g. one that was cut off. Decoding stops at the first
+// entry that can't be read.
+func salvageHistory(data []byte) []HistoryEntry {
+	data = bytes.TrimSpace(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if len(data) > 0 && data[0] == '[' {
+		history := []string{}
+		if _, err := dec.Token(); err != nil {
+			return []HistoryEntry{}
+		}
+
+		for dec.More() {
+			var content string
+			if err := dec.Decode(&content); err != nil {
+				break
+			}
+			history = append(history, content)
+		}
+
+		return legacyEntries(history)
+	}
+
+	entries := []HistoryEntry{}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return entries
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		if key != "entries" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				break
+			}
+			continue
+		}
+
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			break
+		}
+
+		for dec.More() {
+			var stored storedEntry
+			if err := dec.Decode(&stored); err != nil {
+				break
+			}
+			entries = append(entries, stored.entry())
+		}
+		break
+	}
+
+	return entries
+}
+
+// encodeHistory encodes the entries and the last assigned id in the
+// current history file format
+func encodeHistory(entries []HistoryEntry, lastID uint64) ([]byte, error) {
+	file := historyFile{
+		Version: historyVersion,
+		LastID:  lastID,
+		Entries: []storedEntry{},
+	}
+
+	for _, entry := range entries {
+		if entry.str == nil || entry.ephemeral {
+			continue
+		}
+		file.Entries = append(file.Entries, entry.stored())
+	}
+
+	return json.Marshal(file)
+}
+
+func (e HistoryEntry) stored() storedEntry {
+	stored := storedEntry{
+		ID:        e.id,
+		Text:      *e.str,
+		Mime:      e.mimeType,
+		Size:      e.size,
+		Created:   e.created,
+		LastUsed:  e.lastUsed,
+		UseCount:  e.useCount,
+		Pinned:    e.pinned,
+		Hash:      e.hash,
+		Ephemeral: e.ephemeral,
+		Secret:    e.secret,
+	}
+
+	if !e.source.IsEmpty() {
+		stored.Source = &storedSource{App: e.source.app, URL: e.source.url}
+	}
+
+	if e.img != nil {
+		stored.Image = &storedImage{
+			Source:   e.img.source,
+			MimeType: e.img.mimeType,
+			Path:     e.img.path,
+			Size:     e.img.size,
+		}
+	}
+
+	return stored
+}
+
+func (s storedEntry) entry() HistoryEntry {
+	text := s.Text
+	entry := HistoryEntry{
+		id:        s.ID,
+		str:       &text,
+		mimeType:  s.Mime,
+		size:      s.Size,
+		created:   s.Created,
+		lastUsed:  s.LastUsed,
+		useCount:  s.UseCount,
+		pinned:    s.Pinned,
+		hash:      s.Hash,
+		ephemeral: s.Ephemeral,
+		secret:    s.Secret,
+	}
+
+	if s.Source != nil {
+		entry.source = ClipboardSource{app: s.Source.App, url: s.Source.URL}
+	}
+
+	if s.Image != nil {
+		entry.img = &Image{
+			source:   s.Image.Source,
+			mimeType: s.Image.MimeType,
+			path:     s.Image.Path,
+			size:     s.Image.Size,
+		}
+	}
+
+	// entries written before the hash was stored
+	if entry.hash == "" {
+		entry.hash = contentHash(entry)
+	}
+
+	return entry
+}
+
+func (c HistoryChange) stored() storedChange {
+	return storedChange{Kind: c.Kind, Entry: c.Entry.stored()}
+}
+
+func (s storedChange) change() HistoryChange {
+	return HistoryChange{Kind: s.Kind, Entry: s.Entry.entry()}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDecodeHistory(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.png")
+	if err := os.WriteFile(image, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		images  []bool
+		wantErr bool
+	}{
+		{name: "empty file", data: "", want: []string{}},
+		{name: "legacy", data: `["one", "two"]`, want: []string{"one", "two"}, images: []bool{false, false}},
+		{
+			name:   "legacy image",
+			data:   `["file://` + image + `", "file:///missing.png"]`,
+			want:   []string{"file://" + image, "file:///missing.png"},
+			images: []bool{true, false},
+		},
+		{name: "current", data: `{"version":2,"entries":[{"id":7,"text":"one"}]}`, want: []string{"one"}, images: []bool{false}},
+		{name: "newer version", data: `{"version":3,"entries":[]}`, wantErr: true},
+		{name: "invalid legacy", data: `["one", 2]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, _, err := decodeHistory([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeHistory() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := texts(entries); !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+
+			for i, entry := range entries {
+				if (entry.img != nil) != tt.images[i] {
+					t.Errorf("entry %d is image = %v, want %v", i, entry.img != nil, tt.images[i])
+				}
+				if entry.hash == "" {
+					t.Errorf("entry %d has no hash", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLegacyMigration(t *testing.T) {
+	entries, _, err := decodeHistory([]byte(`["one", "two", "one"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ids are assigned in order, duplicates are kept
+	ids := []uint64{}
+	for _, entry := range entries {
+		ids = append(ids, entry.id)
+	}
+	if !slices.Equal(ids, []uint64{1, 2, 3}) {
+		t.Errorf("ids = %v, want [1 2 3]", ids)
+	}
+
+	// a migrated history is written in the current format
+	h := newTestHistory(t)
+	if err := os.WriteFile(h.path, []byte(`["one", "two"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated := reopen(h)
+	if err := migrated.add(NewHistoryEntry("three", nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrated.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != '{' {
+		t.Errorf("history file wasn't migrated: %s", data)
+	}
+
+	if got := texts(reopen(h).entries); !slices.Equal(got, []string{"one", "two", "three"}) {
+		t.Errorf("entries = %v, want [one two three]", got)
+	}
+}
+
+func TestEncodeHistory(t *testing.T) {
+	entry := textEntry(3, "text")
+	entry.pinned = true
+	entry.useCount = 2
+	entry.secret = "jwt"
+	entry.source = ClipboardSource{app: "firefox", url: "https://example.com"}
+
+	data, err := encodeHistory([]HistoryEntry{entry}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, lastID, err := decodeHistory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != 5 {
+		t.Errorf("last id = %d, want 5", lastID)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("entries = %v, want [text]", texts(entries))
+	}
+
+	got := entries[0]
+	if got.id != entry.id || !got.pinned || got.useCount != entry.useCount || got.hash != entry.hash ||
+		got.secret != entry.secret || got.source != entry.source {
+		t.Errorf("decoded %+v, want %+v", got.stored(), entry.stored())
+	}
+}
@@ -1,43 +1,37 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 )
 
-func clipboardHasImage() (Image, bool) {
-	cmd := exec.Command("wl-paste", "--list-types")
-	out, err := cmd.Output()
-
+// clipboardHasImage checks the offered mime types for an image
+func clipboardHasImage(types []string) (Image, bool) {
 	image := Image{}
-	if err != nil {
-		return image, false
-	}
 
-	for line := range bytes.SplitSeq(out, []byte("\n")) {
+	for _, line := range types {
 		var imageSrc ImageSource
 		mimeType := ""
 
-		if strings.HasPrefix(string(line), "-moz-url") {
+		if strings.HasPrefix(line, "-moz-url") {
 			imageSrc = ImageSrcBrowser
 			mimeType = "image/*"
-		} else if strings.HasPrefix(string(line), "text/uri-list") {
+		} else if strings.HasPrefix(line, "text/uri-list") {
 			imageSrc = ImageSrcFileSystem
 			mimeType = "image/*"
 		}
 
-		if strings.HasPrefix(string(line), "image/") {
-			mimeType = string(line)
+		if strings.HasPrefix(line, "image/") {
+			mimeType = line
 		}
 
 		if mimeType != "" {
@@ -50,6 +44,25 @@ func clipboardHasImage() (Image, bool) {
 	return image, false
 }
 
+// passwordManagerHint is the mime type password managers like KeePassXC
+// offer along with the copied secret, its content is "secret"
+const passwordManagerHint = "x-kde-passwordManagerHint"
+
+// clipboardIsSensitive checks whether the clipboard offers the password
+// manager hint and its content marks the clipboard content as secret
+func clipboardIsSensitive(clipboard ClipboardBackend, types []string) bool {
+	index := slices.IndexFunc(types, func(mimeType string) bool {
+		return strings.EqualFold(strings.TrimSpace(mimeType), passwordManagerHint)
+	})
+	if index < 0 {
+		return false
+	}
+
+	hint, err := clipboard.Read(strings.TrimSpace(types[index]))
+
+	return err == nil && strings.TrimSpace(string(hint)) == "secret"
+}
+
 func downloadImage(imgUrl string) (string, error) {
 	savePath := urlToCachePath(imgUrl)
 	// return early if the image is already in the cache
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"time"
+)
+
+const (
+	pollInterval   = 300 * time.Millisecond
+	minWatchDelay  = 500 * time.Millisecond
+	maxWatchDelay  = 30 * time.Second
+	healthyRunTime = 10 * time.Second
+)
+
+// Watcher reports clipboard changes through its events channel.
+// By default it relies on a long-lived child process (e.g. `wl-paste --watch`)
+// which prints a line whenever the clipboard changes. If the child dies
+// it is restarted with an exponential backoff. Polling is only used as a
+// fallback, either when requested or when the command can't be executed.
+// A watcher without command and polling only reports changes that are
+// triggered manually, which is what the fake clipboard uses.
+type Watcher struct {
+	events chan struct{}
+	done   chan struct{}
+	cmd    []string
+	poll   bool
+}
+
+func NewWatcher(cmd []string, poll bool) *Watcher {
+	return &Watcher{
+		// the channel is buffered so that multiple changes that arrive
+		// while the history is still busy are coalesced into one event
+		events: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		cmd:    cmd,
+		poll:   poll,
+	}
+}
+
+// Events returns the channel that receives a value on every
+// clipboard change.
+func (w *Watcher) Events() <-chan struct{} {
+	return w.events
+}
+
+// Start starts watching the clipboard in the background.
+func (w *Watcher) Start() {
+	go func() {
+		// always check the current clipboard content once on start
+		w.notify()
+
+		if w.poll {
+			w.pollLoop()
+			return
+		}
+
+		if len(w.cmd) > 0 {
+			w.watchLoop()
+		}
+	}()
+}
+
+// Stop stops the watcher and its child process.
+func (w *Watcher) Stop() {
+	close(w.done)
+}
+
+func (w *Watcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) pollLoop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.notify()
+		}
+	}
+}
+
+func (w *Watcher) watchLoop() {
+	delay := minWatchDelay
+
+	for {
+		started := time.Now()
+		err := w.watch()
+
+		if errors.Is(err, exec.ErrNotFound) {
+			println(w.cmd[0], "not found, falling back to polling")
+			w.pollLoop()
+			return
+		}
+
+		if err != nil {
+			println("Clipboard watcher stopped:", err.Error())
+		}
+
+		// reset the backoff if the child ran long enough to be considered
+		// healthy, otherwise wait a bit longer with every failed attempt
+		if time.Since(started) > healthyRunTime {
+			delay = minWatchDelay
+		}
+
+		select {
+		case <-w.done:
+			return
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, maxWatchDelay)
+	}
+}
+
+// watch runs the watch command and blocks until the child exits or the
+// watcher is stopped.
+func (w *Watcher) watch() error {
+	cmd := exec.Command(w.cmd[0], w.cmd[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+
+	go func() {
+		select {
+		case <-w.done:
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		w.notify()
+	}
+
+	return cmd.Wait()
+}